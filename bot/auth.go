@@ -0,0 +1,167 @@
+package bot
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	cmn "github.com/jaimeteb/chatto/common"
+)
+
+// AuthConfig models the credentials required by the chat endpoints and by
+// the admin endpoints, the endpoints are open if they have no credentials
+type AuthConfig struct {
+	Chat  Credentials `mapstructure:"chat"`
+	Admin Credentials `mapstructure:"admin"`
+}
+
+// Credentials models the API keys, sent in the X-API-Key header, and the
+// bearer tokens, sent in the Authorization header, that are accepted. Since
+// browsers can't set headers on WebSocket connections, these can send them in
+// the api_key and token query parameters, or a token as a "bearer.<token>"
+// subprotocol.
+type Credentials struct {
+	APIKeys []string `mapstructure:"api_keys"`
+	Tokens  []string `mapstructure:"tokens"`
+}
+
+// Allows tells if a request has one of the API keys or tokens, or if there
+// are none
+func (c Credentials) Allows(r *http.Request) bool {
+	if len(c.APIKeys) == 0 && len(c.Tokens) == 0 {
+		return true
+	}
+
+	if key := r.Header.Get("X-API-Key"); key != "" && contains(c.APIKeys, key) {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if token := strings.TrimPrefix(auth, "Bearer "); token != auth && contains(c.Tokens, token) {
+		return true
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		query := r.URL.Query()
+		if key := query.Get("api_key"); key != "" && contains(c.APIKeys, key) {
+			return true
+		}
+		if token := query.Get("token"); token != "" && contains(c.Tokens, token) {
+			return true
+		}
+		for _, protocol := range websocket.Subprotocols(r) {
+			if token := strings.TrimPrefix(protocol, wsBearer); token != protocol && contains(c.Tokens, token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contains tells if a list has a value, comparing them in constant time so
+// that the secrets in the list don't leak
+func contains(list []string, value string) bool {
+	found := 0
+	for _, v := range list {
+		found |= subtle.ConstantTimeCompare([]byte(v), []byte(value))
+	}
+	return found == 1
+}
+
+// CORSConfig models the origins of the browser clients allowed to call the
+// endpoints, "*" allows any origin
+type CORSConfig struct {
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+	AllowedHeaders []string `mapstructure:"allowed_headers"`
+	MaxAge         int      `mapstructure:"max_age"`
+}
+
+// defaultAllowedHeaders are the headers browser clients can send when none
+// are configured
+var defaultAllowedHeaders = []string{"Content-Type", "Authorization", "X-API-Key"}
+
+// headers adds the CORS headers to the response to a request from an allowed
+// origin, it tells if the request is a preflight request
+func (c CORSConfig) headers(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(c.AllowedOrigins) == 0 {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+	if !contains(c.AllowedOrigins, origin) && !contains(c.AllowedOrigins, "*") {
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+
+	allowed := c.AllowedHeaders
+	if len(allowed) == 0 {
+		allowed = defaultAllowedHeaders
+	}
+	w.Header().Set("Access-Control-Allow-Methods", r.Header.Get("Access-Control-Request-Method"))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(allowed, ", "))
+	if c.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+	}
+	return true
+}
+
+// guard returns a handler that answers the CORS preflight requests of
+// browser clients, rate limits the requests of each IP, and runs h if the
+// request has one of the credentials of the Bot being served
+func (s *Server) guard(credentials func(Bot) Credentials, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bot := s.Bot()
+
+		if bot.CORS.headers(w, r) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		} else if r.Method == http.MethodOptions {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		if !bot.Limits.AllowIP(r, time.Now()) {
+			slowDown(bot.Limits.SlowDown(), w)
+			return
+		}
+
+		if !credentials(bot).Allows(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// slowDown answers the slow down message with 429 Too Many Requests
+func slowDown(msgs interface{}, w http.ResponseWriter) {
+	messages, err := cmn.MessagesFrom(msgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ans := make([]map[string]interface{}, 0, len(messages))
+	for _, msg := range messages {
+		ans = append(ans, msg.Out())
+	}
+
+	js, err := json.Marshal(ans)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(js)
+}
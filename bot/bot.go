@@ -1,14 +1,21 @@
 package bot
 
 import (
+	"context"
+	"errors"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/jaimeteb/chatto/clf"
 	cmn "github.com/jaimeteb/chatto/common"
+	"github.com/jaimeteb/chatto/ent"
 	"github.com/jaimeteb/chatto/ext"
 	"github.com/jaimeteb/chatto/fsm"
+	"github.com/jaimeteb/chatto/handoff"
+	"github.com/jaimeteb/chatto/history"
+	"github.com/jaimeteb/chatto/metrics"
 	"github.com/spf13/viper"
 )
 
@@ -20,13 +27,22 @@ type Bot struct {
 	Classifier clf.Classifier
 	Extension  ext.Extension
 	Clients    Clients
+	History    history.Store
+	Handoff    handoff.Forwarder
+	Auth       AuthConfig
+	CORS       CORSConfig
+	Limits     *Limits
+
+	senders *keyedMutex
 }
 
-// Prediction models a classifier prediction and its orignal string
+// Prediction models a classifier prediction and its orignal string, as well
+// as the entities found in it
 type Prediction struct {
-	Original    string  `json:"original"`
-	Predicted   string  `json:"predicted"`
-	Probability float64 `json:"probability"`
+	Original    string       `json:"original"`
+	Predicted   string       `json:"predicted"`
+	Probability float64      `json:"probability"`
+	Entities    []ent.Entity `json:"entities"`
 }
 
 // Config struct models the bot.yml configuration file
@@ -34,35 +50,268 @@ type Config struct {
 	Name       string               `mapstructure:"bot_name"`
 	Extensions ext.ExtensionsConfig `mapstructure:"extensions"`
 	Store      fsm.StoreConfig      `mapstructure:"store"`
+	History    history.Config       `mapstructure:"history"`
+	Handoff    handoff.Config       `mapstructure:"handoff"`
+	Auth       AuthConfig           `mapstructure:"auth"`
+	RateLimit  RateLimitConfig      `mapstructure:"rate_limit"`
+	CORS       CORSConfig           `mapstructure:"cors"`
 }
 
 // Answer takes a user input and executes a transition on the FSM if possible
 func (b Bot) Answer(mess cmn.Message) interface{} {
-	if !b.Machines.Exists(mess.Sender) {
-		b.Machines.Set(
-			mess.Sender,
-			&fsm.FSM{
-				State: 0,
-				Slots: make(map[string]string),
-			},
-		)
+	return b.answer(mess, "")
+}
+
+// answer answers a message received through a channel and commits the
+// transition right away
+func (b Bot) answer(mess cmn.Message, channel string) interface{} {
+	resp, err := b.process(context.Background(), mess, channel, nil)
+	if err != nil {
+		log.Error(err)
+	}
+	return resp
+}
+
+// maxAttempts is the number of times a message is answered again when the
+// FSM of its sender is changed meanwhile by another replica
+const maxAttempts = 3
+
+// errConflict is returned when the FSM of a sender kept changing
+var errConflict = errors.New("the conversation was changed by another message")
+
+// errDelivery is returned when the responses to a message are not delivered
+var errDelivery = errors.New("the responses were not delivered")
+
+// process answers a message and delivers its responses with send. Messages of
+// the same sender are serialized, and the transition is committed with a
+// compare-and-set so that no transition is lost when several replicas share
+// the store. The transition is committed before the responses are sent, since
+// they can't be taken back, and compensated with rollback if they are not
+// delivered. The messages of a handed off sender are forwarded to the agents
+// instead.
+func (b Bot) process(ctx context.Context, mess cmn.Message, channel string, send func(responses interface{}) error) (interface{}, error) {
+	unlock := b.lock(mess.Sender)
+	defer unlock()
+
+	var r *reply
+	for attempt := 1; ; attempt++ {
+		var err error
+		if r, err = b.prepare(ctx, mess, channel); err != nil {
+			return nil, err
+		}
+
+		ok, err := b.Machines.CompareAndSet(ctx, mess.Sender, r.Stored, r.FSM)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			break
+		} else if attempt == maxAttempts {
+			return r.Responses, errConflict
+		}
+		log.Debugf("FSM of %v changed, answering again", mess.Sender)
+	}
+
+	if r.Forward {
+		if err := b.forward(handoff.Event{Type: handoff.Message, Sender: mess.Sender, Channel: channel, Text: mess.Text}); err != nil {
+			return nil, err
+		}
+	}
+
+	if send != nil {
+		if err := send(r.Responses); err != nil {
+			log.Error(err)
+			b.rollback(ctx, r)
+			return r.Responses, errDelivery
+		}
+	}
+
+	if !r.Forward && r.FSM.Handoff && (r.Stored == nil || !r.Stored.Handoff) {
+		log.Infof("Handing off %v", mess.Sender)
+		if err := b.forward(handoff.Event{Type: handoff.Started, Sender: mess.Sender, Channel: channel, Text: mess.Text}); err != nil {
+			log.Error("Error forwarding handoff:", err)
+		}
+	}
+
+	b.schedule(ctx, mess.Sender, channel, r.FSM)
+	b.record(r)
+	return r.Responses, nil
+}
+
+// reply models the answer to a message: the responses to send, the FSM the
+// sender was in and the FSM it transitions into, or whether the message has
+// to be forwarded because the sender is handed off
+type reply struct {
+	Sender    string
+	Responses interface{}
+	Stored    *fsm.FSM
+	FSM       *fsm.FSM
+	Entry     history.Entry
+	Forward   bool
+}
+
+// prepare executes a transition for a message without committing it
+func (b Bot) prepare(ctx context.Context, mess cmn.Message, channel string) (*reply, error) {
+	stored, err := b.Machines.Get(ctx, mess.Sender)
+	if err == fsm.ErrNotFound {
+		stored = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if stored != nil && stored.Handoff {
+		entry := history.Entry{
+			Sender:  mess.Sender,
+			Channel: channel,
+			Text:    mess.Text,
+			From:    b.Domain.StateName(stored.State),
+			Into:    b.Domain.StateName(stored.State),
+			Handoff: true,
+		}
+		return &reply{Sender: mess.Sender, Responses: []interface{}{}, Stored: stored, FSM: stored, Entry: entry, Forward: true}, nil
+	}
+
+	m := &fsm.FSM{
+		State: 0,
+		Slots: make(map[string]string),
 	}
+	if stored != nil {
+		m = stored.Copy()
+	}
+	initial := m.Copy()
 
 	inputMessage := mess.Text
-	cmd, _ := b.Classifier.Predict(inputMessage)
+	// The commands sent by clients, as buttons or in the command field, and
+	// the values of the choices are only executed if they are in the domain,
+	// otherwise the text of the button is classified as if it was typed
+	cmd, prob := mess.Command, 1.0
+	if cmd != "" && !b.Domain.HasCommand(cmd) {
+		log.Debugf("Ignoring unknown command '%v' from %v", cmd, mess.Sender)
+		cmd = ""
+	}
+	if cmd == "" {
+		if chosen, ok := cmn.Choose(m.Choices, inputMessage); ok && b.Domain.HasCommand(chosen) {
+			cmd = chosen
+		} else if ok {
+			inputMessage = chosen
+		}
+	}
+	if cmd == "" {
+		var sure bool
+		cmd, prob, sure = b.Classifier.Classify(inputMessage)
+		metrics.Probabilities.Observe(prob)
+		if !sure {
+			cmd, prob = "", -1.0
+		}
+	}
+	if cmd != "" && b.Domain.HasCommand(cmd) {
+		metrics.Commands.WithLabelValues(cmd).Inc()
+	}
 
-	m := b.Machines.Get(mess.Sender)
+	from := m.State
 	resp, runExt := m.ExecuteCmd(cmd, inputMessage, b.Domain)
 	if runExt != "" && b.Extension != nil {
-		resp = b.Extension.RunExtFunc(mess.Sender, runExt, inputMessage, b.Domain, m)
+		var err error
+		if resp, err = b.Extension.RunExtFunc(mess.Sender, runExt, inputMessage, b.Domain, m); err != nil {
+			if onError, ok := m.ExecuteError(cmd, from, b.Domain); ok {
+				log.Warnf("Extension function '%v' failed, %v goes into %v", runExt, mess.Sender, b.Domain.StateName(m.State))
+				if onError != nil {
+					resp = onError
+				}
+			} else {
+				log.Warnf("Extension function '%v' failed, keeping the state of %v", runExt, mess.Sender)
+				m = initial
+			}
+		}
 	}
-	b.Machines.Set(mess.Sender, m)
 
-	return resp
+	m.Choices = offered(resp)
+
+	entry := history.Entry{
+		Sender:      mess.Sender,
+		Channel:     channel,
+		Text:        inputMessage,
+		Command:     cmd,
+		Probability: prob,
+		From:        b.Domain.StateName(from),
+		Into:        b.Domain.StateName(m.State),
+		Extension:   runExt,
+	}
+
+	return &reply{Sender: mess.Sender, Responses: resp, Stored: stored, FSM: m, Entry: entry}, nil
+}
+
+// offered returns the buttons and quick replies of the last of the responses
+// that has any, they are kept in the FSM so that the next message of the
+// sender can choose one of them by its number or its text
+func offered(responses interface{}) []cmn.Button {
+	messages, err := cmn.MessagesFrom(responses)
+	if err != nil {
+		return nil
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if choices := messages[i].Choices(); len(choices) > 0 {
+			return choices
+		}
+	}
+	return nil
+}
+
+// rollback compensates a committed transition whose responses were not
+// delivered, restoring the FSM the reply was prepared from or deleting the
+// FSM of a new sender. It's only a compensation: other replicas may have seen
+// the transition meanwhile, and it's kept if the FSM was changed since.
+func (b Bot) rollback(ctx context.Context, r *reply) {
+	if r.Stored != nil {
+		if ok, err := b.Machines.CompareAndSet(ctx, r.Sender, r.FSM, r.Stored); err != nil {
+			log.Errorf("Couldn't roll back the FSM of %v: %v", r.Sender, err)
+		} else if !ok {
+			log.Warnf("Couldn't roll back the FSM of %v, it was changed meanwhile", r.Sender)
+		}
+		return
+	}
+
+	current, err := b.Machines.Get(ctx, r.Sender)
+	if err == fsm.ErrNotFound {
+		return
+	} else if err != nil {
+		log.Errorf("Couldn't roll back the FSM of %v: %v", r.Sender, err)
+	} else if !current.Equal(r.FSM) {
+		log.Warnf("Couldn't roll back the FSM of %v, it was changed meanwhile", r.Sender)
+	} else if err := b.Machines.Delete(ctx, r.Sender); err != nil {
+		log.Errorf("Couldn't roll back the FSM of %v: %v", r.Sender, err)
+	}
+}
+
+// record adds a reply to the history
+func (b Bot) record(r *reply) {
+	if b.History == nil {
+		return
+	}
+
+	responses, err := cmn.MessagesFrom(r.Responses)
+	if err != nil {
+		log.Warn(err)
+	}
+	r.Entry.Time = time.Now()
+	r.Entry.Responses = responses
+	if err := b.History.Add(r.Entry); err != nil {
+		log.Error("Error adding to history:", err)
+	}
 }
 
 // LoadBotConfig loads bot configuration from bot.yml
 func LoadBotConfig(path *string) Config {
+	bc, err := ReadBotConfig(path)
+	if err != nil {
+		log.Warn(err)
+		return Config{}
+	}
+	return bc
+}
+
+// ReadBotConfig reads bot configuration from bot.yml and returns an error if
+// it fails, a missing file is not considered an error
+func ReadBotConfig(path *string) (Config, error) {
 	config := viper.New()
 	config.SetConfigName("bot")
 	config.AddConfigPath(*path)
@@ -70,20 +319,23 @@ func LoadBotConfig(path *string) Config {
 	replacer := strings.NewReplacer(".", "_")
 	config.SetEnvKeyReplacer(replacer)
 
+	var bc Config
+
 	if err := config.ReadInConfig(); err != nil {
 		switch err.(type) {
 		case viper.ConfigFileNotFoundError:
 			log.Warn("File bot.yml not found, using default values")
+			return bc, nil
 		default:
-			log.Warn(err)
+			return bc, err
 		}
-		return Config{}
 	}
 
-	var bc Config
-	config.Unmarshal(&bc)
+	if err := config.Unmarshal(&bc); err != nil {
+		return bc, err
+	}
 
-	return bc
+	return bc, nil
 }
 
 // LoadName loads the bot name from the configuration file
@@ -100,20 +352,116 @@ func LoadName(bcName string) (name string) {
 func LoadBot(path *string) Bot {
 	bc := LoadBotConfig(path)
 
+	// Load Store
+	machines := fsm.LoadStore(bc.Store)
+	// Load History
+	transcripts := history.Load(bc.History)
+
+	bot, err := NewBot(path, bc, machines, transcripts)
+	if err != nil {
+		log.Panic(err)
+	}
+	return bot
+}
+
+// NewBot loads the domain, classifier, extensions and clients found in path
+// and returns a Bot that keeps its conversations and their history in the
+// given stores
+func NewBot(path *string, bc Config, machines fsm.StoreFSM, transcripts history.Store) (Bot, error) {
 	// Load Name
 	name := LoadName(bc.Name)
 	// Load Domain
-	domain := fsm.Create(path)
+	fsmConfig, err := fsm.LoadConfig(path)
+	if err != nil {
+		return Bot{}, err
+	}
+	domain, err := fsm.NewDomain(fsmConfig)
+	if err != nil {
+		return Bot{}, err
+	}
+	domain.BotName = name
 	// Load Classifier
-	classifier := clf.Create(path)
+	classification, err := clf.LoadConfig(path)
+	if err != nil {
+		return Bot{}, err
+	}
+	classifier, err := clf.NewClassifier(classification)
+	if err != nil {
+		return Bot{}, err
+	}
+	// Load clients configuration
+	clientsConfig, err := LoadClientsConfig(path)
+	if err != nil {
+		return Bot{}, err
+	}
 	// Load Extensions
 	extension := ext.LoadExtensions(bc.Extensions)
 	// Load clients
-	clients := LoadClients(path)
-	// Load Store
-	machines := fsm.LoadStore(bc.Store)
+	clients := NewClients(clientsConfig)
+	// Load Handoff
+	forwarder := handoff.Load(bc.Handoff)
+
+	// Load Limits
+	limits := NewLimits(bc.RateLimit)
 
-	return Bot{name, machines, domain, classifier, extension, clients}
+	return Bot{name, machines, domain, classifier, extension, clients, transcripts, forwarder, bc.Auth, bc.CORS, limits, newKeyedMutex()}, nil
+}
+
+// errExtension is returned when the configured extension can't be loaded
+var errExtension = errors.New("couldn't load the extension")
+
+// Reload loads all configurations in path again and returns a new Bot that
+// keeps the stores, rate limits, sender locks and WebSocket sessions of the
+// current one, or an error if any file is invalid or the configured extension
+// can't be loaded
+func (b Bot) Reload(path *string) (Bot, error) {
+	bc, err := ReadBotConfig(path)
+	if err != nil {
+		return b, err
+	}
+
+	newBot, err := NewBot(path, bc, b.Machines, b.History)
+	if err != nil {
+		return b, err
+	}
+	if bc.Extensions.Type != "" && newBot.Extension == nil {
+		if newBot.Handoff != nil {
+			newBot.Handoff.Close()
+		}
+		return b, errExtension
+	}
+	newBot.Limits = b.Limits.With(bc.RateLimit)
+	if b.senders != nil {
+		newBot.senders = b.senders
+	}
+	if b.Clients.WS.sessions != nil {
+		newBot.Clients.WS.sessions = b.Clients.WS.sessions
+	}
+	return newBot, nil
+}
+
+// close closes the extension, the stores and the handoff of the Bot
+func (b Bot) close() {
+	if b.Extension != nil {
+		if err := b.Extension.Close(); err != nil {
+			log.Error(err)
+		}
+	}
+	if b.Machines != nil {
+		if err := b.Machines.Close(); err != nil {
+			log.Error(err)
+		}
+	}
+	if b.History != nil {
+		if err := b.History.Close(); err != nil {
+			log.Error(err)
+		}
+	}
+	if b.Handoff != nil {
+		if err := b.Handoff.Close(); err != nil {
+			log.Error(err)
+		}
+	}
 }
 
 // LOGO for Chatto
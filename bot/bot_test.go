@@ -2,13 +2,39 @@ package bot
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/jaimeteb/chatto/clf"
 	cmn "github.com/jaimeteb/chatto/common"
+	"github.com/jaimeteb/chatto/ext"
+	"github.com/jaimeteb/chatto/fsm"
+	"github.com/jaimeteb/chatto/handoff"
+	"github.com/jaimeteb/chatto/history"
+	"github.com/jaimeteb/chatto/metrics"
+	"github.com/kevinburke/twilio-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/slack-go/slack"
 )
 
 func TestBot1(t *testing.T) {
@@ -135,3 +161,1089 @@ func TestExtFromBot(t *testing.T) {
 		Image:  "",
 	})
 }
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"clf.yml", "fsm.yml"} {
+		data, err := ioutil.ReadFile(filepath.Join("../examples/01_moodbot", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := NewServer(&dir, LoadBot(&dir))
+	machines := server.Bot().Machines
+
+	req1, _ := http.NewRequest("POST", "/admin/reload", nil)
+	w1 := httptest.NewRecorder()
+	server.reloadHandler(w1, req1)
+	if w1.Code != http.StatusOK {
+		t.Errorf("incorrect, got: %v, want: %v.", w1.Code, http.StatusOK)
+	}
+	if server.Bot().Machines != machines {
+		t.Error("incorrect, store was not kept after reload")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "fsm.yml"), []byte("states: [\"off\""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldDomain := server.Bot().Domain
+
+	req2, _ := http.NewRequest("POST", "/admin/reload", nil)
+	w2 := httptest.NewRecorder()
+	server.reloadHandler(w2, req2)
+	if w2.Code != http.StatusUnprocessableEntity {
+		t.Errorf("incorrect, got: %v, want: %v.", w2.Code, http.StatusUnprocessableEntity)
+	}
+	if len(server.Bot().Domain.StateTable) != len(oldDomain.StateTable) {
+		t.Error("incorrect, bot was replaced after a failed reload")
+	}
+
+	// The old extension is closed once the requests using it finish
+	data, _ := ioutil.ReadFile(filepath.Join("../examples/01_moodbot", "fsm.yml"))
+	ioutil.WriteFile(filepath.Join(dir, "fsm.yml"), data, 0644)
+	closed := make(chan struct{})
+	server.mutex.Lock()
+	server.bot.Extension = closingExtension{closed}
+	server.mutex.Unlock()
+	_, release := server.acquire()
+	if err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+		t.Error("incorrect, extension closed while in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("incorrect, extension not closed after its use")
+	}
+
+	// An extension server that can't be reached fails the reload
+	ioutil.WriteFile(filepath.Join(dir, "bot.yml"), []byte("extensions:\n  type: RPC\n  host: localhost\n  port: 1\n"), 0644)
+	if err := server.Reload(); err != errExtension {
+		t.Errorf("incorrect, got: %v, want: %v.", err, errExtension)
+	}
+}
+
+type closingExtension struct {
+	closed chan struct{}
+}
+
+func (e closingExtension) Close() error {
+	close(e.closed)
+	return nil
+}
+
+func (closingExtension) GetAllFuncs() []string {
+	return []string{}
+}
+
+func (closingExtension) RunExtFunc(sender, extName, text string, dom fsm.Domain, m *fsm.FSM) (interface{}, error) {
+	return nil, nil
+}
+
+func TestValidate(t *testing.T) {
+	path := "../examples/01_moodbot/"
+	validation := Validate(&path)
+	if len(validation.Errors) != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", validation.Errors, "[]")
+	}
+	if len(validation.Warnings) != 4 {
+		t.Errorf("incorrect, got: %v, want: %v.", validation.Warnings, 4)
+	}
+
+	dir, err := ioutil.TempDir("", "chatto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, file := range []string{"clf.yml", "fsm.yml"} {
+		data, _ := ioutil.ReadFile(filepath.Join(path, file))
+		ioutil.WriteFile(filepath.Join(dir, file), data, 0644)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "chn.yml"), []byte("twilio:\n  auth_token: token\n"), 0644)
+	if validation := Validate(&dir); len(validation.Errors) != 1 {
+		t.Errorf("incorrect, got: %v, want: %v.", validation.Errors, "webhook_url is required")
+	}
+
+	path = "../examples/404/"
+	validation = Validate(&path)
+	if len(validation.Errors) == 0 {
+		t.Error("incorrect, want: errors")
+	}
+}
+
+func TestPredictEntities(t *testing.T) {
+	path := "../examples/01_moodbot/"
+	bot := LoadBot(&path)
+
+	jsonStr := []byte(`{"text": "hello, my email is foo@bar.com"}`)
+	req, _ := http.NewRequest("POST", "/predict", bytes.NewBuffer(jsonStr))
+	w := httptest.NewRecorder()
+	bot.predictHandler(w, req)
+
+	var prediction Prediction
+	if err := json.NewDecoder(w.Body).Decode(&prediction); err != nil {
+		t.Fatal(err)
+	}
+	if len(prediction.Entities) != 1 || prediction.Entities[0].Value != "foo@bar.com" {
+		t.Errorf("incorrect, got: %v, want: %v.", prediction.Entities, "foo@bar.com")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	path := "../examples/01_moodbot/"
+	bot := LoadBot(&path)
+	bot.History = history.NewMemoryStore()
+
+	for _, text := range []string{"hello", "good", "hey"} {
+		bot.answer(cmn.Message{Sender: "foo", Text: text}, "rest")
+	}
+
+	req, _ := http.NewRequest("GET", "/senders/foo/history?limit=2", nil)
+	req = mux.SetURLVars(req, map[string]string{"sender": "foo"})
+	w := httptest.NewRecorder()
+	bot.historyHandler(w, req)
+
+	var entries []history.Entry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("incorrect, got: %v, want: %v.", len(entries), 2)
+	}
+	if e := entries[0]; e.Text != "good" || e.Command != "good" || e.From != "ask_mood" || e.Into != "initial" || e.Channel != "rest" {
+		t.Errorf("incorrect, got: %+v, want: %v.", e, "good from ask_mood into initial")
+	}
+	if e := entries[1]; len(e.Responses) != 1 || e.Responses[0].Text != "Hello! How are you?" {
+		t.Errorf("incorrect, got: %v, want: %v.", e.Responses, "Hello! How are you?")
+	}
+
+	req, _ = http.NewRequest("GET", "/senders/foo/history?limit=x", nil)
+	req = mux.SetURLVars(req, map[string]string{"sender": "foo"})
+	w = httptest.NewRecorder()
+	bot.historyHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("incorrect, got: %v, want: %v.", w.Code, http.StatusBadRequest)
+	}
+}
+
+func machine(bot Bot, sender string) *fsm.FSM {
+	m, err := bot.Machines.Get(context.Background(), sender)
+	if err != nil {
+		return &fsm.FSM{State: -1}
+	}
+	return m
+}
+
+type failingExtension struct{}
+
+func (failingExtension) Close() error {
+	return nil
+}
+
+func (failingExtension) GetAllFuncs() []string {
+	return []string{"ext_any"}
+}
+
+func (failingExtension) RunExtFunc(sender, extName, text string, dom fsm.Domain, m *fsm.FSM) (interface{}, error) {
+	*m = fsm.FSM{State: 42}
+	return dom.DefaultMessages.Error, &ext.Error{Code: ext.ErrFuncFailed, Message: "oops"}
+}
+
+func TestExtensionError(t *testing.T) {
+	path := "../examples/00_test/"
+	bot := Bot{
+		Machines:   fsm.LoadStore(fsm.StoreConfig{}),
+		Domain:     fsm.Create(&path),
+		Classifier: clf.Create(&path),
+		Extension:  failingExtension{},
+	}
+
+	bot.Answer(cmn.Message{Sender: "foo", Text: "on"})
+
+	if resp := bot.Answer(cmn.Message{Sender: "foo", Text: "hello"}); resp != "Error" {
+		t.Errorf("incorrect, got: %v, want: %v.", resp, "Error")
+	}
+	if state := machine(bot, "foo").State; state != bot.Domain.StateTable["on"] {
+		t.Errorf("incorrect, got: %v, want: %v.", state, bot.Domain.StateTable["on"])
+	}
+}
+
+type failingClient struct{}
+
+func (failingClient) SendMessage(msg cmn.Message, recipient string) error {
+	return fmt.Errorf("unreachable")
+}
+
+func (failingClient) RecieveMessage(w http.ResponseWriter, r *http.Request) (cmn.Message, error) {
+	return cmn.Message{}, nil
+}
+
+func TestDeliveryError(t *testing.T) {
+	path := "../examples/01_moodbot/"
+	bot := LoadBot(&path)
+
+	bot.respond(context.Background(), cmn.Message{Sender: "foo", Text: "hello"}, "rest", &bot.Clients.REST, httptest.NewRecorder())
+	if state := machine(bot, "foo").State; state != bot.Domain.StateTable["ask_mood"] {
+		t.Errorf("incorrect, got: %v, want: %v.", state, bot.Domain.StateTable["ask_mood"])
+	}
+
+	w := httptest.NewRecorder()
+	bot.respond(context.Background(), cmn.Message{Sender: "foo", Text: "good"}, "rest", failingClient{}, w)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("incorrect, got: %v, want: %v.", w.Code, http.StatusInternalServerError)
+	}
+	if state := machine(bot, "foo").State; state != bot.Domain.StateTable["ask_mood"] {
+		t.Errorf("incorrect, got: %v, want: %v.", state, bot.Domain.StateTable["ask_mood"])
+	}
+
+	// A new sender is not kept
+	bot.respond(context.Background(), cmn.Message{Sender: "bar", Text: "hello"}, "rest", failingClient{}, httptest.NewRecorder())
+	if ok, _ := bot.Machines.Exists(context.Background(), "bar"); ok {
+		t.Error("incorrect, want: no FSM for bar")
+	}
+	if count, _ := bot.Machines.Count(context.Background()); count != 1 {
+		t.Errorf("incorrect, got: %v, want: %v.", count, 1)
+	}
+}
+
+func TestConcurrentAnswers(t *testing.T) {
+	path := "../examples/01_moodbot/"
+	bot := LoadBot(&path)
+	bot.History = history.NewMemoryStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		text := "hello"
+		if i%2 == 1 {
+			text = "good"
+		}
+		wg.Add(1)
+		go func(text string) {
+			defer wg.Done()
+			bot.answer(cmn.Message{Sender: "foo", Text: text}, "rest")
+		}(text)
+	}
+	wg.Wait()
+
+	entries, _ := bot.History.Get("foo", 0)
+	if len(entries) != 50 {
+		t.Fatalf("incorrect, got: %v, want: %v.", len(entries), 50)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].From != entries[i-1].Into {
+			t.Errorf("incorrect, entry %v is from %v but the previous one is into %v", i, entries[i].From, entries[i-1].Into)
+		}
+	}
+	if state := bot.Domain.StateName(machine(bot, "foo").State); state != entries[49].Into {
+		t.Errorf("incorrect, got: %v, want: %v.", state, entries[49].Into)
+	}
+}
+
+func TestSendersEndpoints(t *testing.T) {
+	path := "../examples/01_moodbot/"
+	bot := LoadBot(&path)
+
+	for _, sender := range []string{"foo", "bar", "baz"} {
+		bot.Answer(cmn.Message{Sender: sender, Text: "hello"})
+	}
+
+	req1, _ := http.NewRequest("GET", "/senders?limit=2", nil)
+	w1 := httptest.NewRecorder()
+	bot.listHandler(w1, req1)
+
+	var page Senders
+	if err := json.NewDecoder(w1.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Senders) != 2 || page.Senders[0] != "bar" || page.Next != "baz" {
+		t.Errorf("incorrect, got: %v, want: %v.", page, "{[bar baz] baz}")
+	}
+
+	req2, _ := http.NewRequest("DELETE", "/senders/foo", nil)
+	req2 = mux.SetURLVars(req2, map[string]string{"sender": "foo"})
+	w2 := httptest.NewRecorder()
+	bot.deleteHandler(w2, req2)
+	if w2.Code != http.StatusOK {
+		t.Errorf("incorrect, got: %v, want: %v.", w2.Code, http.StatusOK)
+	}
+
+	req3, _ := http.NewRequest("GET", "/senders/foo", nil)
+	req3 = mux.SetURLVars(req3, map[string]string{"sender": "foo"})
+	w3 := httptest.NewRecorder()
+	bot.detailsHandler(w3, req3)
+	if w3.Code != http.StatusNotFound {
+		t.Errorf("incorrect, got: %v, want: %v.", w3.Code, http.StatusNotFound)
+	}
+
+	req4, _ := http.NewRequest("GET", "/senders?after=baz", nil)
+	w4 := httptest.NewRecorder()
+	bot.listHandler(w4, req4)
+	if strings.TrimSpace(w4.Body.String()) != `{"senders":[]}` {
+		t.Errorf("incorrect, got: %v, want: %v.", w4.Body.String(), `{"senders":[]}`)
+	}
+}
+
+type recordingForwarder struct {
+	events []handoff.Event
+}
+
+func (f *recordingForwarder) Forward(event handoff.Event) error {
+	f.events = append(f.events, event)
+	return nil
+}
+
+func (f *recordingForwarder) Close() error {
+	return nil
+}
+
+func TestHandoff(t *testing.T) {
+	path := "../examples/01_moodbot/"
+	bot := LoadBot(&path)
+	bot.History = history.NewMemoryStore()
+	forwarder := &recordingForwarder{}
+	bot.Handoff = forwarder
+
+	bot.answer(cmn.Message{Sender: "foo", Text: "hello"}, "rest")
+
+	req1, _ := http.NewRequest("POST", "/senders/foo/handoff?channel=rest", nil)
+	req1 = mux.SetURLVars(req1, map[string]string{"sender": "foo"})
+	w1 := httptest.NewRecorder()
+	bot.handoffHandler(w1, req1)
+	if w1.Code != http.StatusOK || !machine(bot, "foo").Handoff {
+		t.Errorf("incorrect, got: %v, want: %v.", w1.Code, http.StatusOK)
+	}
+
+	if resp := bot.answer(cmn.Message{Sender: "foo", Text: "good"}, "rest"); len(resp.([]interface{})) != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", resp, "no responses")
+	}
+	if m := machine(bot, "foo"); m.State != bot.Domain.StateTable["ask_mood"] {
+		t.Errorf("incorrect, got: %v, want: %v.", m.State, bot.Domain.StateTable["ask_mood"])
+	}
+
+	body := bytes.NewBufferString(`{"channel": "rest", "messages": ["Hi, I'm an agent"]}`)
+	req2, _ := http.NewRequest("POST", "/senders/foo/handoff/messages", body)
+	req2 = mux.SetURLVars(req2, map[string]string{"sender": "foo"})
+	w2 := httptest.NewRecorder()
+	bot.agentReplyHandler(w2, req2)
+	if w2.Code != http.StatusBadRequest {
+		t.Errorf("incorrect, got: %v, want: %v.", w2.Code, http.StatusBadRequest)
+	}
+
+	req3, _ := http.NewRequest("DELETE", "/senders/foo/handoff", nil)
+	req3 = mux.SetURLVars(req3, map[string]string{"sender": "foo"})
+	w3 := httptest.NewRecorder()
+	bot.handoffHandler(w3, req3)
+	if w3.Code != http.StatusOK || machine(bot, "foo").Handoff {
+		t.Errorf("incorrect, got: %v, want: %v.", w3.Code, http.StatusOK)
+	}
+
+	body = bytes.NewBufferString(`{"channel": "telegram", "messages": ["Hi, I'm an agent"]}`)
+	req4, _ := http.NewRequest("POST", "/senders/foo/handoff/messages", body)
+	req4 = mux.SetURLVars(req4, map[string]string{"sender": "foo"})
+	w4 := httptest.NewRecorder()
+	bot.agentReplyHandler(w4, req4)
+	if w4.Code != http.StatusConflict {
+		t.Errorf("incorrect, got: %v, want: %v.", w4.Code, http.StatusConflict)
+	}
+
+	if resp := bot.answer(cmn.Message{Sender: "foo", Text: "good"}, "rest"); resp != "Great! :)" {
+		t.Errorf("incorrect, got: %v, want: %v.", resp, "Great! :)")
+	}
+
+	types := make([]string, 0)
+	for _, event := range forwarder.events {
+		types = append(types, event.Type)
+	}
+	if fmt.Sprint(types) != "[handoff message release]" || forwarder.events[1].Text != "good" {
+		t.Errorf("incorrect, got: %v, want: %v.", forwarder.events, "[handoff message release]")
+	}
+
+	entries, _ := bot.History.Get("foo", 2)
+	if len(entries) != 2 || !entries[0].Handoff || entries[0].Text != "good" || entries[1].Handoff {
+		t.Errorf("incorrect, got: %+v, want: %v.", entries, "a forwarded message and an answered one")
+	}
+}
+
+// twilioServer fakes the Twilio API for the Twilio client of a bot and
+// records the messages sent
+type twilioServer struct {
+	*httptest.Server
+	mutex sync.Mutex
+	sent  []string
+}
+
+func newTwilioServer(bot *Bot) *twilioServer {
+	server := &twilioServer{sent: make([]string, 0)}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		server.mutex.Lock()
+		server.sent = append(server.sent, r.PostForm.Get("To")+": "+r.PostForm.Get("Body"))
+		server.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}))
+
+	twilioClient := twilio.NewClient("sid", "token", nil)
+	twilioClient.Base = server.URL
+	bot.Clients.Twilio = TwilioClient{Client: twilioClient, Number: "+100"}
+	return server
+}
+
+func TestNotify(t *testing.T) {
+	path := "../examples/01_moodbot/"
+	bot := LoadBot(&path)
+
+	server := newTwilioServer(&bot)
+	defer server.Close()
+
+	notify := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/senders/foo/messages", bytes.NewBufferString(body))
+		req = mux.SetURLVars(req, map[string]string{"sender": "foo"})
+		w := httptest.NewRecorder()
+		bot.notifyHandler(w, req)
+		return w
+	}
+
+	if w := notify(`{"channel": "twilio", "messages": ["Your order shipped"], "command": "greet"}`); w.Code != http.StatusOK {
+		t.Fatalf("incorrect, got: %v, want: %v.", w.Code, http.StatusOK)
+	}
+	if fmt.Sprint(server.sent) != "[foo: Your order shipped foo: Hello! How are you?]" {
+		t.Errorf("incorrect, got: %v, want: %v.", server.sent, "[foo: Your order shipped foo: Hello! How are you?]")
+	}
+	if m := machine(bot, "foo"); m.State != bot.Domain.StateTable["ask_mood"] {
+		t.Errorf("incorrect, got: %v, want: %v.", m.State, bot.Domain.StateTable["ask_mood"])
+	}
+
+	for body, code := range map[string]int{
+		`{"channel": "rest", "messages": ["Hi"]}`:     http.StatusBadRequest,
+		`{"channel": "twilio", "command": "dance"}`:   http.StatusBadRequest,
+		`{"channel": "twilio"}`:                       http.StatusBadRequest,
+		`{"channel": "twilio", "command": "good"}`:    http.StatusOK,
+		`{"channel": "slack", "messages": ["Hello"]}`: http.StatusBadRequest,
+	} {
+		if w := notify(body); w.Code != code {
+			t.Errorf("incorrect, got: %v, want: %v for %v.", w.Code, code, body)
+		}
+	}
+	if m := machine(bot, "foo"); m.State != bot.Domain.StateTable["initial"] {
+		t.Errorf("incorrect, got: %v, want: %v.", m.State, bot.Domain.StateTable["initial"])
+	}
+
+	if resp := bot.Answer(cmn.Message{Sender: "bar", Command: "greet"}); resp != "Hello! How are you?" {
+		t.Errorf("incorrect, got: %v, want: %v.", resp, "Hello! How are you?")
+	}
+
+	// Unknown commands are ignored and the text is classified instead
+	if resp := bot.Answer(cmn.Message{Sender: "baz", Command: "dance", Text: "hello"}); resp != "Hello! How are you?" {
+		t.Errorf("incorrect, got: %v, want: %v.", resp, "Hello! How are you?")
+	}
+	if n := testutil.ToFloat64(metrics.Commands.WithLabelValues("dance")); n != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", n, 0)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	path := "../examples/01_moodbot/"
+	bot := LoadBot(&path)
+	bot.History = history.NewMemoryStore()
+
+	server := newTwilioServer(&bot)
+	defer server.Close()
+
+	askMood, sayBad := bot.Domain.StateTable["ask_mood"], bot.Domain.StateTable["say_bad"]
+	bot.Domain.TimeoutTable = map[int][]fsm.Timeout{
+		askMood: {{State: "ask_mood", After: 60, Message: "Still there?"}},
+		sayBad:  {{State: "say_bad", After: 60, Into: "initial", Message: "Talk to you later."}},
+	}
+
+	bot.answer(cmn.Message{Sender: "foo", Text: "hello"}, "twilio")
+	bot.answer(cmn.Message{Sender: "bar", Text: "hello"}, "twilio")
+	bot.answer(cmn.Message{Sender: "bar", Text: "sad"}, "twilio")
+
+	fire := func(after time.Duration) {
+		timers, err := bot.Machines.Due(context.Background(), time.Now().Add(after))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, timer := range timers {
+			if err := bot.fire(context.Background(), timer); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	fire(30 * time.Second)
+	if len(server.sent) != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", server.sent, "[]")
+	}
+
+	fire(2 * time.Minute)
+	if m := machine(bot, "foo"); m.State != askMood {
+		t.Errorf("incorrect, got: %v, want: %v.", m.State, askMood)
+	}
+	if m := machine(bot, "bar"); m.State != bot.Domain.StateTable["initial"] {
+		t.Errorf("incorrect, got: %v, want: %v.", m.State, bot.Domain.StateTable["initial"])
+	}
+	sort.Strings(server.sent)
+	if fmt.Sprint(server.sent) != "[bar: Talk to you later. foo: Still there?]" {
+		t.Errorf("incorrect, got: %v, want: %v.", server.sent, "[bar: Talk to you later. foo: Still there?]")
+	}
+
+	// Follow-ups are sent only once
+	fire(time.Hour)
+	if len(server.sent) != 2 {
+		t.Errorf("incorrect, got: %v, want: %v.", server.sent, "2 messages")
+	}
+
+	entries, _ := bot.History.Get("bar", 1)
+	if len(entries) != 1 || entries[0].From != "say_bad" || entries[0].Into != "initial" || len(entries[0].Responses) != 1 {
+		t.Errorf("incorrect, got: %+v, want: %v.", entries, "the timeout from say_bad into initial")
+	}
+}
+
+func TestButtons(t *testing.T) {
+	path := "../examples/01_moodbot/"
+	bot := LoadBot(&path)
+	bot.History = nil // The choices are kept in the FSM
+
+	server := newTwilioServer(&bot)
+	defer server.Close()
+
+	choose := cmn.Message{
+		Text: "How are you?",
+		Buttons: []cmn.Button{
+			{Text: "Good", Payload: "good"},
+			{Text: "Bad", Payload: "bad"},
+			{Text: "Help", URL: "https://example.com"},
+		},
+	}
+	if _, err := bot.Notify(context.Background(), "foo", "twilio", []interface{}{choose}, "greet"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bot.Notify(context.Background(), "foo", "twilio", []interface{}{choose}, ""); err != nil {
+		t.Fatal(err)
+	}
+	want := "foo: How are you?\n1. Good\n2. Bad\nHelp: https://example.com"
+	if len(server.sent) != 3 || server.sent[2] != want {
+		t.Fatalf("incorrect, got: %v, want: %v.", server.sent, want)
+	}
+
+	resp, err := cmn.MessagesFrom(bot.answer(cmn.Message{Sender: "foo", Text: "2"}, "twilio"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := machine(bot, "foo"); m.State != bot.Domain.StateTable["say_bad"] {
+		t.Errorf("incorrect, got: %v, want: %v.", m.State, bot.Domain.StateTable["say_bad"])
+	}
+	want = "Did that help?\n1. Yes\n2. No"
+	if text := resp[len(resp)-1].PlainText(); text != want {
+		t.Errorf("incorrect, got: %v, want: %v.", text, want)
+	}
+
+	if resp := bot.Answer(cmn.Message{Sender: "foo", Text: "no"}); fmt.Sprint(resp) != "Oh I'm sorry" {
+		t.Errorf("incorrect, got: %v, want: %v.", resp, "Oh I'm sorry")
+	}
+
+	messages, err := cmn.MessagesFrom(map[interface{}]interface{}{
+		"text":  "Pick one",
+		"cards": []interface{}{map[interface{}]interface{}{"title": "A", "buttons": []interface{}{map[interface{}]interface{}{"text": "Go", "payload": "good"}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload, ok := messages[0].Choose("go"); !ok || payload != "good" {
+		t.Errorf("incorrect, got: %v, want: %v.", payload, "good")
+	}
+
+	// A button without a payload sends its text on every channel
+	plain := cmn.Message{
+		Text:    "How are you?",
+		Buttons: []cmn.Button{{Text: "I am sad"}, {Text: "Help", URL: "https://example.com"}},
+	}
+	if markup, _ := telegramMarkup(plain.Buttons, nil); !strings.Contains(markup, `"callback_data":"I am sad"`) {
+		t.Errorf("incorrect, got: %v, want: %v.", markup, "the text as callback_data")
+	}
+	blocks := slackBlocks(plain)
+	if button := blocks[0].(*slack.ActionBlock).Elements.ElementSet[0].(*slack.ButtonBlockElement); button.Value != "I am sad" {
+		t.Errorf("incorrect, got: %v, want: %v.", button.Value, "I am sad")
+	}
+	want = "How are you?\n1. I am sad\nHelp: https://example.com"
+	if text := plain.PlainText(); text != want {
+		t.Errorf("incorrect, got: %v, want: %v.", text, want)
+	}
+
+	if _, err := bot.Notify(context.Background(), "foo", "twilio", nil, "greet"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bot.Notify(context.Background(), "foo", "twilio", []interface{}{plain}, ""); err != nil {
+		t.Fatal(err)
+	}
+	bot.answer(cmn.Message{Sender: "foo", Text: "1"}, "twilio")
+	if m := machine(bot, "foo"); m.State != bot.Domain.StateTable["say_bad"] {
+		t.Errorf("incorrect, got: %v, want: %v.", m.State, bot.Domain.StateTable["say_bad"])
+	}
+}
+
+func TestInteractive(t *testing.T) {
+	path := "../examples/01_moodbot/"
+	bot := LoadBot(&path)
+	bot.History = history.NewMemoryStore()
+
+	bot.Answer(cmn.Message{Sender: "42", Text: "hello"})
+
+	update := `{"update_id": 2, "callback_query": {"id": "7", "from": {"id": 42}, "data": "bad",
+		"message": {"message_id": 1, "text": "How are you?", "reply_markup": {"inline_keyboard": [[{"text": "Good", "callback_data": "good"}], [{"text": "Not so good", "callback_data": "bad"}]]}}}}`
+	req, _ := http.NewRequest("POST", "", strings.NewReader(update))
+	mess, err := bot.Clients.Telegram.RecieveMessage(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mess.Sender != "42" || mess.Text != "Not so good" || mess.Command != "bad" {
+		t.Errorf("incorrect, got: %+v, want: %v.", mess, "bad from 42")
+	}
+
+	bot.Answer(mess)
+	entries, _ := bot.History.Get("42", 1)
+	if e := entries[0]; e.Text != "Not so good" || e.Command != "bad" || e.Probability != 1 || e.Into != "say_bad" {
+		t.Errorf("incorrect, got: %+v, want: %v.", e, "bad into say_bad")
+	}
+
+	payload := `{"type": "block_actions", "channel": {"id": "C1"}, "actions": [{"block_id": "quick_replies", "action_id": "quick_replies_0", "type": "button", "text": {"type": "plain_text", "text": "Yes"}, "value": "yes"}]}`
+	req, _ = http.NewRequest("POST", "", strings.NewReader(url.Values{"payload": {payload}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	mess, err = bot.Clients.Slack.RecieveMessage(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mess.Sender != "C1" || mess.Text != "Yes" || mess.Command != "yes" {
+		t.Errorf("incorrect, got: %+v, want: %v.", mess, "yes from C1")
+	}
+
+	payload = `{"type": "block_actions", "channel": {"id": "C1"}, "actions": [{"block_id": "buttons", "action_id": "buttons_0", "type": "button", "text": {"type": "plain_text", "text": "Help"}, "url": "https://example.com"}]}`
+	req, _ = http.NewRequest("POST", "", strings.NewReader(url.Values{"payload": {payload}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	bot.slackEndpointHandler(w, req)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("incorrect, got: %v %v, want: %v.", w.Code, w.Body, http.StatusOK)
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	clients := Clients{
+		Telegram: TelegramClient{SecretToken: "telegram"},
+		Twilio:   TwilioClient{AuthToken: "twilio", WebhookURL: "https://example.com/endpoints/twilio"},
+		Slack:    SlackClient{SigningSecret: "slack"},
+	}
+
+	receive := func(client Client, body string, header map[string]string) int {
+		req, _ := http.NewRequest("POST", "", strings.NewReader(body))
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		client.RecieveMessage(w, req)
+		return w.Code
+	}
+
+	update := `{"update_id": 1, "message": {"from": {"id": 42}, "text": "hi"}}`
+	if code := receive(&clients.Telegram, update, map[string]string{"X-Telegram-Bot-Api-Secret-Token": "telegram"}); code != http.StatusOK {
+		t.Errorf("incorrect, got: %v, want: %v.", code, http.StatusOK)
+	}
+	if code := receive(&clients.Telegram, update, map[string]string{"X-Telegram-Bot-Api-Secret-Token": "guess"}); code != http.StatusUnauthorized {
+		t.Errorf("incorrect, got: %v, want: %v.", code, http.StatusUnauthorized)
+	}
+
+	form := url.Values{"From": {"+42"}, "Body": {"hi"}, "To": {"+100"}}.Encode()
+	mac := hmac.New(sha1.New, []byte("twilio"))
+	mac.Write([]byte("https://example.com/endpoints/twilio" + "Body" + "hi" + "From" + "+42" + "To" + "+100"))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if code := receive(&clients.Twilio, form, map[string]string{"X-Twilio-Signature": signature}); code != http.StatusOK {
+		t.Errorf("incorrect, got: %v, want: %v.", code, http.StatusOK)
+	}
+	if code := receive(&clients.Twilio, strings.Replace(form, "hi", "bye", 1), map[string]string{"X-Twilio-Signature": signature}); code != http.StatusUnauthorized {
+		t.Errorf("incorrect, got: %v, want: %v.", code, http.StatusUnauthorized)
+	}
+	if code := receive(&TwilioClient{AuthToken: "twilio"}, form, map[string]string{"X-Twilio-Signature": signature}); code != http.StatusUnauthorized {
+		t.Errorf("incorrect, got: %v, want: %v.", code, http.StatusUnauthorized)
+	}
+
+	event := `{"event": {"channel": "C1", "text": "hi"}}`
+	sign := func(ts time.Time) map[string]string {
+		timestamp := strconv.FormatInt(ts.Unix(), 10)
+		mac := hmac.New(sha256.New, []byte("slack"))
+		mac.Write([]byte("v0:" + timestamp + ":" + event))
+		return map[string]string{
+			"X-Slack-Request-Timestamp": timestamp,
+			"X-Slack-Signature":         "v0=" + hex.EncodeToString(mac.Sum(nil)),
+		}
+	}
+	if slack := NewClients(ClientsConfig{Slack: SlackConfig{SigningSecret: "slack"}}).Slack; slack.Client == nil {
+		t.Error("incorrect, want: a Slack client without a token")
+	}
+	if code := receive(&clients.Slack, event, sign(time.Now())); code != http.StatusOK {
+		t.Errorf("incorrect, got: %v, want: %v.", code, http.StatusOK)
+	}
+	if code := receive(&clients.Slack, event, sign(time.Now().Add(-10*time.Minute))); code != http.StatusUnauthorized {
+		t.Errorf("incorrect, got: %v, want: %v.", code, http.StatusUnauthorized)
+	}
+	if code := receive(&clients.Slack, event, nil); code != http.StatusUnauthorized {
+		t.Errorf("incorrect, got: %v, want: %v.", code, http.StatusUnauthorized)
+	}
+}
+
+func TestAccess(t *testing.T) {
+	path := "../examples/01_moodbot/"
+	bot := LoadBot(&path)
+	bot.Auth = AuthConfig{
+		Chat:  Credentials{APIKeys: []string{"chat"}},
+		Admin: Credentials{Tokens: []string{"admin"}},
+	}
+	bot.CORS = CORSConfig{AllowedOrigins: []string{"https://example.com"}}
+	bot.Limits = NewLimits(RateLimitConfig{
+		Sender:  Bucket{Rate: 0.01, Burst: 2},
+		IP:      Bucket{Rate: 0.01, Burst: 6},
+		Message: "Easy there",
+	})
+
+	server := httptest.NewServer(NewServer(&path, bot).Router(""))
+	defer server.Close()
+
+	do := func(method, path, body string, header map[string]string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	chat := map[string]string{"X-API-Key": "chat", "Origin": "https://example.com"}
+	for _, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if resp := do("POST", "/endpoints/rest", `{"sender": "foo", "text": "hello"}`, chat); resp.StatusCode != want {
+			t.Errorf("incorrect, got: %v, want: %v.", resp.StatusCode, want)
+		} else if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "https://example.com" {
+			t.Errorf("incorrect, got: %v, want: %v.", origin, "https://example.com")
+		}
+	}
+	if resp := do("POST", "/endpoints/rest", `{"sender": "bar", "text": "hello"}`, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("incorrect, got: %v, want: %v.", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	if resp := do("GET", "/senders/foo", "", chat); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("incorrect, got: %v, want: %v.", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if resp := do("GET", "/senders/foo", "", map[string]string{"Authorization": "Bearer admin"}); resp.StatusCode != http.StatusOK {
+		t.Errorf("incorrect, got: %v, want: %v.", resp.StatusCode, http.StatusOK)
+	}
+
+	preflight := map[string]string{"Origin": "https://example.com", "Access-Control-Request-Method": "POST"}
+	if resp := do("OPTIONS", "/endpoints/rest", "", preflight); resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Headers") == "" {
+		t.Errorf("incorrect, got: %v, want: %v.", resp.StatusCode, http.StatusNoContent)
+	}
+	preflight["Origin"] = "https://example.org"
+	if resp := do("OPTIONS", "/endpoints/rest", "", preflight); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("incorrect, got: %v, want: %v.", resp.StatusCode, http.StatusForbidden)
+	}
+
+	// Requests without credentials count towards the limit of their IP too
+	if resp := do("GET", "/senders/foo", "", nil); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("incorrect, got: %v, want: %v.", resp.StatusCode, http.StatusTooManyRequests)
+	}
+}
+
+func TestWebSocketAuth(t *testing.T) {
+	path := "../examples/01_moodbot/"
+	bot := LoadBot(&path)
+	bot.Auth.Chat = Credentials{APIKeys: []string{"key"}, Tokens: []string{"token"}}
+
+	server := httptest.NewServer(NewServer(&path, bot).Router(""))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/endpoints/ws"
+
+	for _, c := range []struct {
+		query     string
+		protocols []string
+		want      int
+	}{
+		{"", nil, http.StatusUnauthorized},
+		{"?token=guess", nil, http.StatusUnauthorized},
+		{"?token=token", nil, http.StatusSwitchingProtocols},
+		{"?api_key=key", nil, http.StatusSwitchingProtocols},
+		{"", []string{"chatto", "bearer.guess"}, http.StatusUnauthorized},
+		{"", []string{"chatto", "bearer.token"}, http.StatusSwitchingProtocols},
+	} {
+		dialer := websocket.Dialer{Subprotocols: c.protocols}
+		conn, resp, err := dialer.Dial(url+c.query, nil)
+		if resp == nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.want {
+			t.Errorf("incorrect, got: %v, want: %v.", resp.StatusCode, c.want)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+
+	// The query parameters are only accepted on WebSocket connections
+	resp, err := http.Post(server.URL+"/endpoints/ws?token=token", "application/json", strings.NewReader(`{"sender": "42", "text": "hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("incorrect, got: %v, want: %v.", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.2:4321"
+	req.Header.Add("X-Forwarded-For", "6.6.6.6, 1.1.1.1")
+	req.Header.Add("X-Forwarded-For", "10.0.0.1")
+
+	for _, c := range []struct {
+		header string
+		hops   int
+		want   string
+	}{
+		{"", 0, "10.0.0.2"},
+		{"X-Real-IP", 0, "10.0.0.2"},
+		{"X-Forwarded-For", 0, "10.0.0.1"},
+		{"X-Forwarded-For", 1, "1.1.1.1"},
+		{"X-Forwarded-For", 5, "6.6.6.6"},
+	} {
+		if ip := clientIP(req, c.header, c.hops); ip != c.want {
+			t.Errorf("incorrect, got: %v, want: %v.", ip, c.want)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	path := "../examples/01_moodbot/"
+	bot := LoadBot(&path)
+
+	server := httptest.NewServer(NewServer(&path, bot).Router(""))
+	defer server.Close()
+
+	dial := func(query string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/endpoints/ws"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	read := func(conn *websocket.Conn) wsFrame {
+		var frame wsFrame
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+
+	conn := dial("")
+	hello := read(conn)
+	session := hello.Session
+	if hello.Type != wsSession || !sessionID.MatchString(session) {
+		t.Fatalf("incorrect, got: %+v, want: %v.", hello, "a new session")
+	}
+
+	conn.WriteJSON(wsFrame{Type: wsMessage, Message: map[string]interface{}{"text": "hello"}})
+	if frame := read(conn); frame.Type != wsTyping || !*frame.Typing {
+		t.Errorf("incorrect, got: %+v, want: %v.", frame, "typing")
+	}
+	if frame := read(conn); frame.Type != wsMessage || frame.Seq != 1 || frame.Message["text"] != "Hello! How are you?" {
+		t.Errorf("incorrect, got: %+v, want: %v.", frame, "Hello! How are you?")
+	}
+	if frame := read(conn); frame.Type != wsTyping || *frame.Typing {
+		t.Errorf("incorrect, got: %+v, want: %v.", frame, "not typing")
+	}
+	conn.Close()
+
+	if _, err := bot.Notify(context.Background(), session, "ws", []interface{}{"Are you there?"}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	conn = dial("?session=" + session + "&last=1")
+	defer conn.Close()
+	if frame := read(conn); frame.Session != session || frame.Seq != 2 {
+		t.Errorf("incorrect, got: %+v, want: %v.", frame, session)
+	}
+	if frame := read(conn); frame.Seq != 2 || frame.Message["text"] != "Are you there?" {
+		t.Errorf("incorrect, got: %+v, want: %v.", frame, "Are you there?")
+	}
+
+	resp, err := http.Post(server.URL+"/endpoints/ws", "application/json", strings.NewReader(`{"sender": "`+session+`", "text": "good"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("incorrect, got: %v, want: %v.", resp.StatusCode, http.StatusOK)
+	}
+	if frame := read(conn); frame.Seq != 3 || frame.Message["text"] != "Great! :)" {
+		t.Errorf("incorrect, got: %+v, want: %v.", frame, "Great! :)")
+	}
+
+	resp, err = http.Post(server.URL+"/endpoints/ws", "application/json", strings.NewReader(`{"sender": "42", "text": "hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("incorrect, got: %v, want: %v.", resp.StatusCode, http.StatusNotFound)
+	}
+
+	// Sessions without connections expire
+	bot.Clients.WS.prune(time.Now().Add(2 * defaultWSSessionTTL))
+	if !bot.Clients.WS.has(session) {
+		t.Error("incorrect, want: a connected session is kept")
+	}
+	conn.Close()
+	for i := 0; i < 50 && bot.Clients.WS.has(session); i++ {
+		time.Sleep(100 * time.Millisecond)
+		bot.Clients.WS.prune(time.Now().Add(2 * defaultWSSessionTTL))
+	}
+	if bot.Clients.WS.has(session) {
+		t.Error("incorrect, want: an expired session is removed")
+	}
+
+	large := dial("")
+	defer large.Close()
+	read(large)
+	large.WriteJSON(wsFrame{Type: wsMessage, Message: map[string]interface{}{"text": strings.Repeat("a", wsReadLimit)}})
+	large.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := large.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("incorrect, got: %v, want: %v.", err, websocket.CloseMessageTooBig)
+	}
+}
+
+func TestHub(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	manifest := filepath.Join(dir, "bots.yml")
+	ioutil.WriteFile(manifest, []byte("bots:\n  - name: mood\n    path: ../../examples/01_moodbot\nadmin:\n  tokens: [secret]\n"), 0644)
+	m, err := LoadManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bots := m.Bots; len(bots) != 1 || bots[0].Name != "mood" || bots[0].Path != filepath.Join(dir, "../../examples/01_moodbot") {
+		t.Errorf("incorrect, got: %v, want: %v.", bots, "the mood bot")
+	}
+	if m.Root != dir || len(m.Admin.Tokens) != 1 {
+		t.Errorf("incorrect, got: %+v, want: %v.", m, dir)
+	}
+	if m, _ := LoadManifest("../examples"); len(m.Bots) != 5 || m.Bots[1].Name != "01_moodbot" || m.Root != "../examples" {
+		t.Errorf("incorrect, got: %v, want: %v.", m.Bots, "the examples")
+	}
+
+	hub := NewHub("../examples", Credentials{Tokens: []string{"secret"}})
+	if err := hub.Add("mood", "../examples/01_moodbot"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.Add("mood/2", "../examples/01_moodbot"); err == nil {
+		t.Error("incorrect, want: error for an invalid name")
+	}
+
+	server := httptest.NewServer(hub.Router())
+	defer server.Close()
+
+	admin := func(method, path, body, token string) int {
+		req, _ := http.NewRequest(method, server.URL+path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := admin("PUT", "/bots/other", `{"path": "01_moodbot"}`, "guess"); code != http.StatusUnauthorized {
+		t.Errorf("incorrect, got: %v, want: %v.", code, http.StatusUnauthorized)
+	}
+	if code := admin("PUT", "/bots/other", `{"path": "../bot"}`, "secret"); code != http.StatusForbidden {
+		t.Errorf("incorrect, got: %v, want: %v.", code, http.StatusForbidden)
+	}
+	if code := admin("PUT", "/bots/other", `{"path": "01_moodbot"}`, "secret"); code != http.StatusOK {
+		t.Fatalf("incorrect, got: %v, want: %v.", code, http.StatusOK)
+	}
+
+	answer := func(bot, text string) []cmn.Message {
+		body := bytes.NewBufferString(fmt.Sprintf(`{"sender": "foo", "text": "%v"}`, text))
+		resp, err := http.Post(server.URL+"/bots/"+bot+"/endpoints/rest", "application/json", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var messages []cmn.Message
+		json.NewDecoder(resp.Body).Decode(&messages)
+		return messages
+	}
+
+	answer("mood", "hello")
+	if messages := answer("mood", "good"); len(messages) != 1 || messages[0].Text != "Great! :)" {
+		t.Errorf("incorrect, got: %v, want: %v.", messages, "Great! :)")
+	}
+	if messages := answer("other", "good"); len(messages) != 1 || messages[0].Text != "Unknown command, try again please." {
+		t.Errorf("incorrect, got: %v, want: %v.", messages, "Unknown command, try again please.")
+	}
+
+	// A sender is locked apart in every bot
+	hub.mutex.RLock()
+	unlock := hub.servers["mood"].Bot().lock("foo")
+	hub.mutex.RUnlock()
+	answered := make(chan []cmn.Message, 1)
+	go func() { answered <- answer("other", "good") }()
+	select {
+	case <-answered:
+	case <-time.After(5 * time.Second):
+		t.Error("incorrect, want: the sender not locked in the other bot")
+	}
+	unlock()
+
+	req, _ := http.NewRequest("GET", server.URL+"/bots", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, _ := http.DefaultClient.Do(req)
+	var list []HubBot
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 2 || list[0].Name != "mood" || list[1].Name != "other" {
+		t.Errorf("incorrect, got: %v, want: %v.", list, "[mood other]")
+	}
+
+	if code := admin("DELETE", "/bots/mood", "", "secret"); code != http.StatusOK {
+		t.Errorf("incorrect, got: %v, want: %v.", code, http.StatusOK)
+	}
+	if resp, _ := http.Post(server.URL+"/bots/mood/endpoints/rest", "application/json", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("incorrect, got: %v, want: %v.", resp.StatusCode, http.StatusNotFound)
+	}
+	if bot := machine(hub.servers["other"].Bot(), "foo"); bot.State != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", bot.State, 0)
+	}
+}
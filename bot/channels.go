@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ajg/form"
 	cmn "github.com/jaimeteb/chatto/common"
@@ -24,11 +24,13 @@ type ClientsConfig struct {
 	Telegram TelegramConfig `mapstructure:"telegram"`
 	Twilio   TwilioConfig   `mapstructure:"twilio"`
 	Slack    SlackConfig    `mapstructure:"slack"`
+	WS       WSConfig       `mapstructure:"ws"`
 }
 
 // TelegramConfig models Telegram configuration
 type TelegramConfig struct {
-	BotKey string `mapstructure:"bot_key"`
+	BotKey      string `mapstructure:"bot_key"`
+	SecretToken string `mapstructure:"secret_token"`
 }
 
 // TwilioConfig models Twilio configuration
@@ -36,11 +38,13 @@ type TwilioConfig struct {
 	AccountSid string `mapstructure:"account_sid"`
 	AuthToken  string `mapstructure:"auth_token"`
 	Number     string `mapstructure:"number"`
+	WebhookURL string `mapstructure:"webhook_url"`
 }
 
-// SlackConfig contains the Slack token
+// SlackConfig contains the Slack token and signing secret
 type SlackConfig struct {
-	Token string `mapstructure:"token"`
+	Token         string `mapstructure:"token"`
+	SigningSecret string `mapstructure:"signing_secret"`
 }
 
 // Clients struct combines all available clients
@@ -49,26 +53,35 @@ type Clients struct {
 	Twilio   TwilioClient
 	REST     RESTClient
 	Slack    SlackClient
+	WS       WSClient
 }
 
-// TwilioClient contains a Twilio client as well as the Twilio number
+// TwilioClient contains a Twilio client as well as the Twilio number, the
+// requests are verified with the auth token for the WebhookURL, and rejected
+// if it's not set
 type TwilioClient struct {
-	Client *twilio.Client
-	Number string
+	Client     *twilio.Client
+	Number     string
+	AuthToken  string
+	WebhookURL string
 }
 
-// TelegramClient contains a Telegram client
+// TelegramClient contains a Telegram client, the requests are verified if
+// the SecretToken is set
 type TelegramClient struct {
-	Client *telegram.Client
+	Client      *telegram.Client
+	SecretToken string
 }
 
 // RESTClient contains a REST client
 type RESTClient struct {
 }
 
-// SlackClient contains a Slack Client
+// SlackClient contains a Slack Client, the requests are verified if the
+// SigningSecret is set
 type SlackClient struct {
-	Client *slack.Client
+	Client        *slack.Client
+	SigningSecret string
 }
 
 // Client interface implements a SendMessage method that sends message through an API client
@@ -77,21 +90,61 @@ type Client interface {
 	RecieveMessage(w http.ResponseWriter, r *http.Request) (cmn.Message, error)
 }
 
-// SendMessage for Twilio
+// client returns the configured client of a channel that can send messages
+// on its own, REST can only answer the requests it receives
+func (c *Clients) client(channel string) (Client, bool) {
+	switch channel {
+	case "telegram":
+		return &c.Telegram, c.Telegram.Client != nil
+	case "twilio":
+		return &c.Twilio, c.Twilio.Client != nil
+	case "slack":
+		return &c.Slack, c.Slack.Client != nil
+	case "ws":
+		return &c.WS, c.WS.sessions != nil
+	}
+	return nil, false
+}
+
+// SendMessage for Twilio, buttons, cards and quick replies are sent as text
+// and the images of the cards and the files as media
 func (t *TwilioClient) SendMessage(msg cmn.Message, recipient string) error {
-	var imageURL []*url.URL
+	var mediaURL []*url.URL
 
-	if msg.Image != "" {
-		u, _ := url.Parse(msg.Image)
-		imageURL = append(imageURL, u)
+	media := []string{msg.Image}
+	for _, card := range msg.Cards {
+		media = append(media, card.Image)
 	}
-	ret, err := t.Client.Messages.SendMessage(t.Number, recipient, msg.Text, imageURL)
+	for _, file := range msg.Files {
+		media = append(media, file.URL)
+	}
+	for _, m := range media {
+		if m == "" {
+			continue
+		}
+		u, err := url.Parse(m)
+		if err != nil {
+			return err
+		}
+		mediaURL = append(mediaURL, u)
+	}
+
+	ret, err := t.Client.Messages.SendMessage(t.Number, recipient, msg.PlainText(), mediaURL)
 	log.Debug(ret, err)
 	return err
 }
 
 // RecieveMessage for Twilio
 func (t *TwilioClient) RecieveMessage(w http.ResponseWriter, r *http.Request) (cmn.Message, error) {
+	if t.WebhookURL == "" {
+		http.Error(w, errTwilioWebhook.Error(), http.StatusUnauthorized)
+		return cmn.Message{}, errTwilioWebhook
+	}
+	if err := verifyTwilio(r, t.AuthToken, t.WebhookURL); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return cmn.Message{}, err
+	}
+
 	decoder := form.NewDecoder(r.Body)
 	var twilioMessage TwilioMessageIn
 	if err := decoder.Decode(&twilioMessage); err != nil {
@@ -110,31 +163,128 @@ func (t *TwilioClient) RecieveMessage(w http.ResponseWriter, r *http.Request) (c
 	return mess, nil
 }
 
-// SendMessage for Telegram
+// SendMessage for Telegram, buttons are sent as an inline keyboard and quick
+// replies as a one time keyboard, each card and file is sent as a message of
+// its own
 func (t *TelegramClient) SendMessage(msg cmn.Message, recipient string) error {
+	if msg.Text != "" || msg.Image != "" || (len(msg.Cards) == 0 && len(msg.Files) == 0) {
+		markup, err := telegramMarkup(msg.Buttons, msg.QuickReplies)
+		if err != nil {
+			return err
+		}
+		if err := t.send(recipient, msg.Text, msg.Image, markup); err != nil {
+			return err
+		}
+	}
+
+	for _, card := range msg.Cards {
+		text := card.Title
+		if card.Subtitle != "" {
+			text += "\n" + card.Subtitle
+		}
+		markup, err := telegramMarkup(card.Buttons, nil)
+		if err != nil {
+			return err
+		}
+		if err := t.send(recipient, text, card.Image, markup); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range msg.Files {
+		values := url.Values{}
+		values.Add("chat_id", recipient)
+		values.Add("document", file.URL)
+		values.Add("caption", file.Name)
+		if err := t.call("SendDocument", values); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// send sends a text, or an image with the text as caption, with a keyboard
+func (t *TelegramClient) send(recipient, text, image, markup string) error {
 	respValues := url.Values{}
 	respValues.Add("chat_id", recipient)
 	respValues.Add("parse_mode", "Markdown")
+	if markup != "" {
+		respValues.Add("reply_markup", markup)
+	}
 
 	var method string
-	if msg.Image != "" {
-		respValues.Add("photo", msg.Image)
-		respValues.Add("caption", msg.Text)
+	if image != "" {
+		respValues.Add("photo", image)
+		respValues.Add("caption", text)
 		method = "SendPhoto"
 	} else {
-		respValues.Add("text", msg.Text)
+		respValues.Add("text", text)
 		method = "SendMessage"
 	}
 
-	apiResp := new(interface{})
-	t.Client.Call(method, respValues, apiResp)
-	log.Debug(*apiResp)
+	return t.call(method, respValues)
+}
 
+// call calls a method of the Telegram API and returns an error if it fails
+func (t *TelegramClient) call(method string, values url.Values) error {
+	apiResp := struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}{}
+	t.Client.Call(method, values, &apiResp)
+	log.Debug(apiResp)
+
+	if !apiResp.OK {
+		return fmt.Errorf("telegram %v failed: %v", method, apiResp.Description)
+	}
 	return nil
 }
 
+// telegramMarkup returns the reply markup for buttons and quick replies, an
+// inline keyboard if there are buttons or a keyboard that hides once used if
+// there are only quick replies
+func telegramMarkup(buttons, quickReplies []cmn.Button) (string, error) {
+	var markup interface{}
+	if len(buttons) > 0 {
+		keyboard := make([][]map[string]string, 0, len(buttons)+len(quickReplies))
+		for _, button := range append(buttons, quickReplies...) {
+			key := map[string]string{"text": button.Text}
+			if button.URL != "" {
+				key["url"] = button.URL
+			} else {
+				key["callback_data"] = button.Value()
+			}
+			keyboard = append(keyboard, []map[string]string{key})
+		}
+		markup = map[string]interface{}{"inline_keyboard": keyboard}
+	} else if len(quickReplies) > 0 {
+		keyboard := make([][]map[string]string, 0, len(quickReplies))
+		for _, quickReply := range quickReplies {
+			keyboard = append(keyboard, []map[string]string{{"text": quickReply.Text}})
+		}
+		markup = map[string]interface{}{
+			"keyboard":          keyboard,
+			"one_time_keyboard": true,
+			"resize_keyboard":   true,
+		}
+	} else {
+		return "", nil
+	}
+
+	js, err := json.Marshal(markup)
+	return string(js), err
+}
+
 // RecieveMessage for Telegram
 func (t *TelegramClient) RecieveMessage(w http.ResponseWriter, r *http.Request) (cmn.Message, error) {
+	if t.SecretToken != "" {
+		if err := verifyTelegram(r, t.SecretToken); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return cmn.Message{}, err
+		}
+	}
+
 	decoder := json.NewDecoder(r.Body)
 	var telegramMess TelegramMessageIn
 
@@ -145,6 +295,20 @@ func (t *TelegramClient) RecieveMessage(w http.ResponseWriter, r *http.Request)
 	}
 
 	log.Debug(telegramMess)
+
+	if query := telegramMess.CallbackQuery; query != nil {
+		if t.Client != nil {
+			if err := t.call("answerCallbackQuery", url.Values{"callback_query_id": {query.ID}}); err != nil {
+				log.Warn(err)
+			}
+		}
+		return cmn.Message{
+			Sender:  strconv.Itoa(query.From.ID),
+			Text:    query.ButtonText(),
+			Command: query.Data,
+		}, nil
+	}
+
 	sender := strconv.Itoa(telegramMess.Message.From.ID)
 	mess := cmn.Message{
 		Sender: sender,
@@ -173,9 +337,11 @@ func (c *RESTClient) RecieveMessage(w http.ResponseWriter, r *http.Request) (cmn
 	return mess, nil
 }
 
-// SendMessage for Slack
+// SendMessage for Slack, buttons and quick replies are sent as button blocks
+// and cards as sections with an image
 func (s *SlackClient) SendMessage(msg cmn.Message, recipient string) error {
 	slackMsgOptions := []slack.MsgOption{}
+	blocks := slackBlocks(msg)
 
 	if msg.Image != "" {
 		var imageText *slack.TextBlockObject
@@ -184,23 +350,92 @@ func (s *SlackClient) SendMessage(msg cmn.Message, recipient string) error {
 		} else {
 			imageText = nil
 		}
-		image := slack.MsgOptionBlocks(slack.NewImageBlock(msg.Image, "image", "1", imageText))
-		slackMsgOptions = append(slackMsgOptions, image)
+		blocks = append([]slack.Block{slack.NewImageBlock(msg.Image, "image", "1", imageText)}, blocks...)
 	} else if msg.Text != "" {
 		text := slack.MsgOptionText(msg.Text, false)
 		slackMsgOptions = append(slackMsgOptions, text)
+		if len(blocks) > 0 {
+			section := slack.NewSectionBlock(slack.NewTextBlockObject("mrkdwn", msg.Text, false, false), nil, nil)
+			blocks = append([]slack.Block{section}, blocks...)
+		}
+	}
+
+	if len(blocks) > 0 {
+		slackMsgOptions = append(slackMsgOptions, slack.MsgOptionBlocks(blocks...))
 	}
 
 	ret, _, err := s.Client.PostMessage(recipient, slackMsgOptions...)
 	log.Debugf("%v - %v\n", ret, err)
 
-	return nil
+	return err
 }
 
-// RecieveMessage for Slack
+// slackBlocks returns the blocks for the buttons, cards, quick replies and
+// files of a message
+func slackBlocks(msg cmn.Message) []slack.Block {
+	blocks := make([]slack.Block, 0)
+	actions := func(id string, buttons []cmn.Button) {
+		if len(buttons) == 0 {
+			return
+		}
+		elements := make([]slack.BlockElement, 0, len(buttons))
+		for i, button := range buttons {
+			element := slack.NewButtonBlockElement(
+				fmt.Sprintf("%v_%v", id, i),
+				button.Value(),
+				slack.NewTextBlockObject("plain_text", button.Text, false, false),
+			)
+			element.URL = button.URL
+			elements = append(elements, element)
+		}
+		blocks = append(blocks, slack.NewActionBlock(id, elements...))
+	}
+
+	actions("buttons", msg.Buttons)
+	for i, card := range msg.Cards {
+		text := "*" + card.Title + "*"
+		if card.Subtitle != "" {
+			text += "\n" + card.Subtitle
+		}
+		var accessory *slack.Accessory
+		if card.Image != "" {
+			accessory = slack.NewAccessory(slack.NewImageBlockElement(card.Image, card.Title))
+		}
+		blocks = append(blocks, slack.NewSectionBlock(
+			slack.NewTextBlockObject("mrkdwn", text, false, false), nil, accessory,
+		))
+		actions(fmt.Sprintf("card_%v", i), card.Buttons)
+	}
+	actions("quick_replies", msg.QuickReplies)
+	for _, file := range msg.Files {
+		name := file.Name
+		if name == "" {
+			name = file.URL
+		}
+		blocks = append(blocks, slack.NewSectionBlock(
+			slack.NewTextBlockObject("mrkdwn", fmt.Sprintf("<%v|%v>", file.URL, name), false, false), nil, nil,
+		))
+	}
+
+	return blocks
+}
+
+// RecieveMessage for Slack, a message is received from the events API and a
+// button press from the interactivity payloads, that are form encoded
 func (s *SlackClient) RecieveMessage(w http.ResponseWriter, r *http.Request) (cmn.Message, error) {
 	log.Debug(r.Body)
 
+	if s.SigningSecret != "" {
+		if err := verifySlack(r, s.SigningSecret, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return cmn.Message{}, err
+		}
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return s.recieveAction(w, r)
+	}
+
 	var event SlackMessage
 
 	decoder := json.NewDecoder(r.Body)
@@ -234,44 +469,47 @@ func (s *SlackClient) RecieveMessage(w http.ResponseWriter, r *http.Request) (cm
 	return msg, nil
 }
 
+// recieveAction returns the button pressed in a block_actions interactivity
+// payload as a message with its value as command, other payloads and the
+// buttons that only open a URL are ignored
+func (s *SlackClient) recieveAction(w http.ResponseWriter, r *http.Request) (cmn.Message, error) {
+	var callback slack.InteractionCallback
+	if err := json.Unmarshal([]byte(r.FormValue("payload")), &callback); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return cmn.Message{}, err
+	}
+
+	log.Debug(callback.Type)
+	if callback.Type != slack.InteractionTypeBlockActions {
+		return cmn.Message{}, nil
+	}
+
+	for _, action := range callback.ActionCallback.BlockActions {
+		if action.Value == "" {
+			continue
+		}
+		return cmn.Message{
+			Sender:  callback.Channel.ID,
+			Text:    action.Text.Text,
+			Command: action.Value,
+		}, nil
+	}
+	return cmn.Message{}, nil
+}
+
 // SendMessages sends messages through the clients
 func SendMessages(msgs interface{}, client Client, recipient string, w http.ResponseWriter) error {
-	ans := make([]map[string]string, 0)
+	ans := make([]map[string]interface{}, 0)
 
-	// Create slice of messages
-	msgsArr := make([]interface{}, 0)
-	if rt := reflect.TypeOf(msgs); rt.Kind() == reflect.Slice {
-		msgsArr = msgs.([]interface{})
-	} else {
-		msgsArr = append(msgsArr, msgs)
+	messages, err := cmn.MessagesFrom(msgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
 	}
 
-	for _, msgElem := range msgsArr {
-		switch m := msgElem.(type) {
-		case cmn.Message:
-			ans = append(ans, m.Out())
-			if err := client.SendMessage(m, recipient); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return err
-			}
-		case string:
-			msg := cmn.Message{
-				Text: m,
-			}
-			ans = append(ans, msg.Out())
-			if err := client.SendMessage(msg, recipient); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return err
-			}
-		case map[interface{}]interface{}, map[string]interface{}, map[string]string:
-			msg := cmn.MessageFromMap(m)
-			ans = append(ans, msg.Out())
-			if err := client.SendMessage(msg, recipient); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return err
-			}
-		default:
-			err := fmt.Errorf("Message type unsupported: %T", m)
+	for _, msg := range messages {
+		ans = append(ans, msg.Out())
+		if err := client.SendMessage(msg, recipient); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return err
 		}
@@ -291,6 +529,17 @@ func SendMessages(msgs interface{}, client Client, recipient string, w http.Resp
 
 // LoadClients loads registered clients/channels in the chn.yml file
 func LoadClients(path *string) Clients {
+	end, err := LoadClientsConfig(path)
+	if err != nil {
+		log.Warn(err)
+		return Clients{}
+	}
+	return NewClients(end)
+}
+
+// LoadClientsConfig loads the chn.yml file and returns an error if it fails,
+// a missing file is not considered an error
+func LoadClientsConfig(path *string) (ClientsConfig, error) {
 	config := viper.New()
 	config.SetConfigName("chn")
 	config.AddConfigPath(*path)
@@ -298,44 +547,55 @@ func LoadClients(path *string) Clients {
 	replacer := strings.NewReplacer(".", "_")
 	config.SetEnvKeyReplacer(replacer)
 
-	var cts Clients
+	var end ClientsConfig
 
 	if err := config.ReadInConfig(); err != nil {
 		switch err.(type) {
 		case viper.ConfigFileNotFoundError:
 			log.Warn("File chn.yml not found, skipping channels")
+			return end, nil
 		default:
-			log.Warn(err)
+			return end, err
 		}
-		return cts
 	}
 
-	var end ClientsConfig
 	if err := config.Unmarshal(&end); err != nil {
-		log.Warn(err)
-		return cts
+		return end, err
 	}
 
+	return end, nil
+}
+
+// NewClients creates the clients/channels in the given configuration
+func NewClients(end ClientsConfig) Clients {
+	var cts Clients
+
 	// TELEGRAM
 	if end.Telegram != (TelegramConfig{}) {
 		telegramClient := telegram.NewClient(end.Telegram.BotKey)
-		cts.Telegram = TelegramClient{telegramClient}
+		cts.Telegram = TelegramClient{telegramClient, end.Telegram.SecretToken}
 		log.Infof("Added Telegram client: %v\n", telegramClient.GetMe().ID)
 	}
 
 	// TWILIO
 	if end.Twilio != (TwilioConfig{}) {
 		twilioClient := twilio.NewClient(end.Twilio.AccountSid, end.Twilio.AuthToken, nil)
-		cts.Twilio = TwilioClient{twilioClient, end.Twilio.Number}
+		cts.Twilio = TwilioClient{twilioClient, end.Twilio.Number, end.Twilio.AuthToken, end.Twilio.WebhookURL}
 		log.Infof("Added Twilio client: %v\n", twilioClient.AccountSid)
+		if end.Twilio.WebhookURL == "" {
+			log.Warn(errTwilioWebhook)
+		}
 	}
 
 	// SLACK
 	if end.Slack != (SlackConfig{}) {
 		slackClient := slack.New(end.Slack.Token)
-		cts.Slack = SlackClient{slackClient}
-		log.Infof("Added Slack client: %v...\n", end.Slack.Token[:10])
+		cts.Slack = SlackClient{slackClient, end.Slack.SigningSecret}
+		log.Info("Added Slack client")
 	}
 
+	// WEBSOCKET
+	cts.WS = NewWSClient(end.WS)
+
 	return cts
 }
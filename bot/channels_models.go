@@ -4,16 +4,51 @@ import "github.com/slack-go/slack"
 
 // TelegramMessageIn models a telegram incoming message
 type TelegramMessageIn struct {
-	UpdateID int                    `json:"update_id"`
-	Message  TelegramMessageInInner `json:"message"`
+	UpdateID      int                    `json:"update_id"`
+	Message       TelegramMessageInInner `json:"message"`
+	CallbackQuery *TelegramCallbackQuery `json:"callback_query"`
 }
 
 // TelegramMessageInInner models a telegram incoming message inner struct
 type TelegramMessageInInner struct {
-	MessageID int                        `json:"message_id"`
-	From      TelegramMessageInInnerFrom `json:"from"`
-	Date      int                        `json:"date"`
-	Text      string                     `json:"text"`
+	MessageID   int                        `json:"message_id"`
+	From        TelegramMessageInInnerFrom `json:"from"`
+	Date        int                        `json:"date"`
+	Text        string                     `json:"text"`
+	ReplyMarkup TelegramReplyMarkup        `json:"reply_markup"`
+}
+
+// TelegramReplyMarkup models the inline keyboard of a telegram message
+type TelegramReplyMarkup struct {
+	InlineKeyboard [][]TelegramButton `json:"inline_keyboard"`
+}
+
+// TelegramButton models a button of a telegram inline keyboard
+type TelegramButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+// TelegramCallbackQuery models a telegram callback query, sent when a button
+// of an inline keyboard is pressed
+type TelegramCallbackQuery struct {
+	ID      string                     `json:"id"`
+	From    TelegramMessageInInnerFrom `json:"from"`
+	Message TelegramMessageInInner     `json:"message"`
+	Data    string                     `json:"data"`
+}
+
+// ButtonText returns the text of the button that was pressed, or its data if
+// the button is not found
+func (q *TelegramCallbackQuery) ButtonText() string {
+	for _, row := range q.Message.ReplyMarkup.InlineKeyboard {
+		for _, button := range row {
+			if button.CallbackData == q.Data {
+				return button.Text
+			}
+		}
+	}
+	return q.Data
 }
 
 // TelegramMessageInInnerFrom models a telegram incoming message inner struct
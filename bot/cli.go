@@ -59,7 +59,7 @@ func CLI(port *int) {
 		}, localEndpoint)
 		color.Cyan("botto :")
 		for _, msg := range *respMess {
-			fmt.Println(msg.Text)
+			fmt.Println(msg.PlainText())
 		}
 	}
 }
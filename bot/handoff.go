@@ -0,0 +1,131 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jaimeteb/chatto/fsm"
+	"github.com/jaimeteb/chatto/handoff"
+	"github.com/jaimeteb/chatto/history"
+	log "github.com/sirupsen/logrus"
+)
+
+// errNotHandedOff is returned when an agent replies to a sender that is not
+// handed off
+var errNotHandedOff = errors.New("the sender is not handed off")
+
+// errNoChannel is returned when messages can't be sent through a channel on
+// their own, because it doesn't exist, isn't configured or is REST
+var errNoChannel = errors.New("the channel can't send messages")
+
+// forward forwards an event of a handed off conversation to the agents, it
+// is dropped if there is no handoff configured
+func (b Bot) forward(event handoff.Event) error {
+	if b.Handoff == nil {
+		log.Warnf("No handoff configured, dropping the %v event of %v", event.Type, event.Sender)
+		return nil
+	}
+	event.Time = time.Now()
+	return b.Handoff.Forward(event)
+}
+
+// StartHandoff hands off the conversation of a sender to the agents, the bot
+// doesn't answer the sender until the conversation is released
+func (b Bot) StartHandoff(ctx context.Context, sender, channel string) error {
+	return b.setHandoff(ctx, sender, channel, true)
+}
+
+// ReleaseHandoff gives the conversation of a sender back to the bot, which
+// goes on from the state the sender was handed off in
+func (b Bot) ReleaseHandoff(ctx context.Context, sender string) error {
+	return b.setHandoff(ctx, sender, "", false)
+}
+
+// setHandoff sets whether a sender is handed off and tells the agents when
+// it changes
+func (b Bot) setHandoff(ctx context.Context, sender, channel string, handedOff bool) error {
+	unlock := b.lock(sender)
+	defer unlock()
+
+	for attempt := 1; ; attempt++ {
+		stored, err := b.Machines.Get(ctx, sender)
+		if err == fsm.ErrNotFound {
+			stored = nil
+		} else if err != nil {
+			return err
+		}
+
+		m := &fsm.FSM{
+			State: 0,
+			Slots: make(map[string]string),
+		}
+		if stored != nil {
+			m = stored.Copy()
+		}
+		if m.Handoff == handedOff {
+			return nil
+		}
+		m.Handoff = handedOff
+
+		ok, err := b.Machines.CompareAndSet(ctx, sender, stored, m)
+		if err != nil {
+			return err
+		} else if ok {
+			break
+		} else if attempt == maxAttempts {
+			return errConflict
+		}
+	}
+
+	event := handoff.Event{Type: handoff.Started, Sender: sender, Channel: channel}
+	if handedOff {
+		if err := b.Machines.Schedule(ctx, sender, nil); err != nil {
+			log.Errorf("Error cancelling the timeouts of %v: %v", sender, err)
+		}
+	} else {
+		event.Type = handoff.Released
+	}
+	log.Infof("Handoff of %v: %v", sender, event.Type)
+	if err := b.forward(event); err != nil {
+		log.Error("Error forwarding handoff:", err)
+	}
+	return nil
+}
+
+// Reply sends the messages of an agent to a handed off sender through a
+// channel and adds them to the history
+func (b Bot) Reply(ctx context.Context, sender, channel string, msgs interface{}) error {
+	m, err := b.Machines.Get(ctx, sender)
+	if err == fsm.ErrNotFound || (err == nil && !m.Handoff) {
+		return errNotHandedOff
+	} else if err != nil {
+		return err
+	}
+
+	client, ok := b.Clients.client(channel)
+	if !ok {
+		return errNoChannel
+	}
+
+	messages, err := push(msgs, client, sender)
+	if err != nil {
+		return err
+	}
+
+	if b.History != nil {
+		entry := history.Entry{
+			Time:      time.Now(),
+			Sender:    sender,
+			Channel:   channel,
+			From:      b.Domain.StateName(m.State),
+			Into:      b.Domain.StateName(m.State),
+			Responses: messages,
+			Handoff:   true,
+		}
+		if err := b.History.Add(entry); err != nil {
+			log.Error("Error adding to history:", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/jaimeteb/chatto/fsm"
+	"github.com/jaimeteb/chatto/history"
+	"github.com/jaimeteb/chatto/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// HubBot models a bot served by a Hub, as listed in a manifest
+type HubBot struct {
+	Name string `mapstructure:"name" json:"name"`
+	Path string `mapstructure:"path" json:"path"`
+}
+
+// Manifest models a manifest file with the bots to serve, the directory
+// the bots added at runtime have to be in and the credentials required to
+// list, add and remove them
+type Manifest struct {
+	Bots  []HubBot    `mapstructure:"bots"`
+	Root  string      `mapstructure:"root"`
+	Admin Credentials `mapstructure:"admin"`
+}
+
+// Hub serves several bots in the same process, each one under /bots/{name}
+// and with its own Server, bots can be added from Root and removed at runtime
+type Hub struct {
+	Root  string
+	Admin Credentials
+
+	mutex   sync.RWMutex
+	servers map[string]*Server
+	routers map[string]http.Handler
+}
+
+// NewHub returns a Hub without bots
+func NewHub(root string, admin Credentials) *Hub {
+	return &Hub{
+		Root:    root,
+		Admin:   admin,
+		servers: make(map[string]*Server),
+		routers: make(map[string]http.Handler),
+	}
+}
+
+// errOutsideRoot is returned when a bot added at runtime is not in the root
+// directory of the Hub
+var errOutsideRoot = errors.New("the bot path is outside the bots directory")
+
+// resolve returns the path of a bot added at runtime, relative to the root
+// directory of the Hub, or an error if it's outside of it
+func (h *Hub) resolve(path string) (string, error) {
+	if h.Root == "" {
+		return "", errOutsideRoot
+	}
+	root, err := filepath.Abs(h.Root)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	rel, err := filepath.Rel(root, filepath.Clean(path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errOutsideRoot
+	}
+	return filepath.Join(root, rel), nil
+}
+
+var botName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Add loads the bot in path and serves it under a name, replacing the bot
+// with the same name if there is one
+func (h *Hub) Add(name, path string) error {
+	if !botName.MatchString(name) {
+		return fmt.Errorf("invalid bot name '%v'", name)
+	}
+
+	bot, err := loadHubBot(name, path)
+	if err != nil {
+		return err
+	}
+	server := NewServer(&path, bot)
+	router := server.Router(name + "/")
+
+	h.mutex.Lock()
+	old := h.servers[name]
+	h.servers[name] = server
+	h.routers[name] = router
+	h.mutex.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	server.Start()
+	log.Infof("Serving bot '%v' from %v", name, path)
+	return nil
+}
+
+// Remove stops serving a bot, it returns false if there is no bot with the
+// name
+func (h *Hub) Remove(name string) bool {
+	h.mutex.Lock()
+	server, ok := h.servers[name]
+	delete(h.servers, name)
+	delete(h.routers, name)
+	h.mutex.Unlock()
+
+	if ok {
+		server.Close()
+		log.Infof("Removed bot '%v'", name)
+	}
+	return ok
+}
+
+// Bots returns the bots being served sorted by name
+func (h *Hub) Bots() []HubBot {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	bots := make([]HubBot, 0, len(h.servers))
+	for name, server := range h.servers {
+		bots = append(bots, HubBot{Name: name, Path: *server.Path})
+	}
+	sort.Slice(bots, func(i, j int) bool {
+		return bots[i].Name < bots[j].Name
+	})
+	return bots
+}
+
+// Count returns the number of senders of all the bots being served
+func (h *Hub) Count() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	total := 0
+	for name, server := range h.servers {
+		count, err := server.Bot().Machines.Count(context.Background())
+		if err != nil {
+			log.Errorf("Error counting senders of '%v': %v", name, err)
+		}
+		total += count
+	}
+	return total
+}
+
+// loadHubBot loads the bot in path, its stores are isolated from the ones of
+// the other bots with the key prefix "<name>:" unless one is configured
+func loadHubBot(name, path string) (Bot, error) {
+	bc, err := ReadBotConfig(&path)
+	if err != nil {
+		return Bot{}, err
+	}
+	if bc.Store.Prefix == "" {
+		bc.Store.Prefix = name + ":"
+	}
+	if bc.History.Prefix == "" {
+		bc.History.Prefix = name + ":"
+	}
+	if bc.History.Type == "FILE" && bc.History.Path == "" {
+		bc.History.Path = filepath.Join("history", name)
+	}
+
+	machines, err := fsm.NewStore(bc.Store)
+	if err != nil {
+		return Bot{}, err
+	}
+	transcripts := history.Load(bc.History)
+
+	return NewBot(&path, bc, machines, transcripts)
+}
+
+// LoadManifest returns the manifest in a file, or the bots in the
+// subdirectories of a directory that have an fsm.yml file, named after them,
+// with the credentials in its hub.yml file if there is one. The paths in a
+// manifest are relative to it, and the root is its directory unless set.
+func LoadManifest(path string) (Manifest, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	if info.IsDir() {
+		manifest := Manifest{Bots: make([]HubBot, 0), Root: path}
+		if hub := filepath.Join(path, "hub.yml"); fileExists(hub) {
+			m, err := readManifest(hub)
+			if err != nil {
+				return Manifest{}, err
+			}
+			manifest.Admin = m.Admin
+		}
+
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return Manifest{}, err
+		}
+		for _, file := range files {
+			dir := filepath.Join(path, file.Name())
+			if file.IsDir() && fileExists(filepath.Join(dir, "fsm.yml")) {
+				manifest.Bots = append(manifest.Bots, HubBot{Name: file.Name(), Path: dir})
+			}
+		}
+		return manifest, nil
+	}
+
+	manifest, err := readManifest(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+	bots := make([]HubBot, 0, len(manifest.Bots))
+	for _, bot := range manifest.Bots {
+		if !filepath.IsAbs(bot.Path) {
+			bot.Path = filepath.Join(filepath.Dir(path), bot.Path)
+		}
+		bots = append(bots, bot)
+	}
+	manifest.Bots = bots
+	if !filepath.IsAbs(manifest.Root) {
+		manifest.Root = filepath.Join(filepath.Dir(path), manifest.Root)
+	}
+	return manifest, nil
+}
+
+func readManifest(path string) (Manifest, error) {
+	config := viper.New()
+	config.SetConfigFile(path)
+	if err := config.ReadInConfig(); err != nil {
+		return Manifest{}, err
+	}
+	var manifest Manifest
+	if err := config.Unmarshal(&manifest); err != nil {
+		return Manifest{}, err
+	}
+	return manifest, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (h *Hub) botHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["bot"]
+
+	h.mutex.RLock()
+	router, ok := h.routers[name]
+	h.mutex.RUnlock()
+	if !ok {
+		http.Error(w, "unknown bot: "+name, http.StatusNotFound)
+		return
+	}
+
+	http.StripPrefix("/bots/"+name, router).ServeHTTP(w, r)
+}
+
+func (h *Hub) listHandler(w http.ResponseWriter, r *http.Request) {
+	js, err := json.Marshal(h.Bots())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (h *Hub) addHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["bot"]
+
+	var bot HubBot
+	if err := json.NewDecoder(r.Body).Decode(&bot); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	path, err := h.resolve(bot.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if err := h.Add(name, path); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	js, err := json.Marshal(map[string]bool{"added": true})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (h *Hub) removeHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["bot"]
+
+	if !h.Remove(name) {
+		http.Error(w, "unknown bot: "+name, http.StatusNotFound)
+		return
+	}
+
+	js, err := json.Marshal(map[string]bool{"removed": true})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// admin returns a handler that runs h if the request has one of the admin
+// credentials of the Hub, the endpoints are closed if it has none since they
+// load bots from the filesystem
+func (h *Hub) admin(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(h.Admin.APIKeys) == 0 && len(h.Admin.Tokens) == 0 || !h.Admin.Allows(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// Router returns a router with the endpoints of every bot under
+// /bots/{bot}, and the endpoints to list, add and remove bots, which require
+// the admin credentials of the Hub
+func (h *Hub) Router() *mux.Router {
+	r := mux.NewRouter()
+
+	// Bot Endpoints
+	r.PathPrefix("/bots/{bot}/").HandlerFunc(h.botHandler)
+
+	// Admin Endpoints
+	r.Handle("/bots", metrics.Instrument("bots", h.admin(h.listHandler))).Methods("GET")
+	r.Handle("/bots/{bot}", metrics.Instrument("add", h.admin(h.addHandler))).Methods("PUT")
+	r.Handle("/bots/{bot}", metrics.Instrument("remove", h.admin(h.removeHandler))).Methods("DELETE")
+
+	return r
+}
+
+// ServeBots serves the bots in a manifest file or directory
+func ServeBots(manifest *string, port *int) {
+	m, err := LoadManifest(*manifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	hub := NewHub(m.Root, m.Admin)
+	for _, bot := range m.Bots {
+		if err := hub.Add(bot.Name, bot.Path); err != nil {
+			log.Errorf("Couldn't load bot '%v': %v", bot.Name, err)
+		}
+	}
+
+	log.Info("Server started")
+
+	r := hub.Router()
+
+	if err := metrics.RegisterSenders(hub.Count, metrics.SendersInterval); err != nil {
+		log.Warn(err)
+	}
+
+	// Metrics Endpoint
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", *port), r))
+}
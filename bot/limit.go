@@ -0,0 +1,157 @@
+package bot
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig models the rate limits of the messages of each sender and
+// the requests of each IP, and the message that is answered when they are
+// exceeded. The IP is taken from IPHeader if it's set, for example
+// X-Forwarded-For behind a proxy, skipping the entries added by the
+// TrustedProxies closest to Chatto.
+type RateLimitConfig struct {
+	Sender         Bucket      `mapstructure:"sender"`
+	IP             Bucket      `mapstructure:"ip"`
+	IPHeader       string      `mapstructure:"ip_header"`
+	TrustedProxies int         `mapstructure:"trusted_proxies"`
+	Message        interface{} `mapstructure:"message"`
+}
+
+// Bucket models a token bucket that is refilled with Rate tokens per second
+// up to Burst tokens, a zero Rate disables the limit
+type Bucket struct {
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+}
+
+// defaultSlowDown is answered to the messages that exceed a rate limit when
+// there is no message configured
+const defaultSlowDown = "You're going too fast, please slow down."
+
+// Limits rate limits the messages of each sender and the requests of each IP
+type Limits struct {
+	RateLimitConfig
+
+	senders *limiter
+	ips     *limiter
+}
+
+// NewLimits returns Limits with empty buckets
+func NewLimits(rc RateLimitConfig) *Limits {
+	return &Limits{rc, newLimiter(), newLimiter()}
+}
+
+// With returns Limits with another configuration that keep the buckets of l
+func (l *Limits) With(rc RateLimitConfig) *Limits {
+	if l == nil {
+		return NewLimits(rc)
+	}
+	return &Limits{rc, l.senders, l.ips}
+}
+
+// AllowSender takes a token from the bucket of a sender and tells if there
+// was one
+func (l *Limits) AllowSender(sender string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	return l.senders.allow(sender, l.Sender, now)
+}
+
+// AllowIP takes a token from the bucket of the IP of a request and tells if
+// there was one
+func (l *Limits) AllowIP(r *http.Request, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	return l.ips.allow(clientIP(r, l.IPHeader, l.TrustedProxies), l.IP, now)
+}
+
+// SlowDown returns the message answered when a limit is exceeded
+func (l *Limits) SlowDown() interface{} {
+	if l == nil || l.Message == nil {
+		return defaultSlowDown
+	}
+	return l.Message
+}
+
+// clientIP returns the IP a request comes from. If header is set and present
+// it's the entry hops from the right, since the entries on the left can be
+// sent by the client, or the left-most one if there are fewer.
+func clientIP(r *http.Request, header string, hops int) string {
+	if header != "" {
+		if forwarded := r.Header[http.CanonicalHeaderKey(header)]; len(forwarded) > 0 {
+			entries := strings.Split(strings.Join(forwarded, ","), ",")
+			i := len(entries) - 1 - hops
+			if i < 0 {
+				i = 0
+			}
+			return strings.TrimSpace(entries[i])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limiter is a set of token buckets identified by a key, created when they
+// are first used and removed once they are full again
+type limiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokens
+	pruned  time.Time
+}
+
+type tokens struct {
+	count float64
+	last  time.Time
+}
+
+// pruneInterval is how often the full buckets are removed
+const pruneInterval = time.Minute
+
+func newLimiter() *limiter {
+	return &limiter{buckets: make(map[string]*tokens)}
+}
+
+// allow refills the bucket of a key and takes a token from it, it tells if
+// there was one
+func (l *limiter) allow(key string, bucket Bucket, now time.Time) bool {
+	if bucket.Rate <= 0 {
+		return true
+	}
+	burst := math.Max(float64(bucket.Burst), 1)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.pruned) > pruneInterval {
+		for k, t := range l.buckets {
+			if t.count+now.Sub(t.last).Seconds()*bucket.Rate >= burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+
+	t, ok := l.buckets[key]
+	if !ok {
+		t = &tokens{count: burst, last: now}
+		l.buckets[key] = t
+	}
+	t.count = math.Min(burst, t.count+now.Sub(t.last).Seconds()*bucket.Rate)
+	t.last = now
+
+	if t.count < 1 {
+		return false
+	}
+	t.count--
+	return true
+}
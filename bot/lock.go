@@ -0,0 +1,58 @@
+package bot
+
+import "sync"
+
+// keyedMutex is a set of mutexes identified by a key, created when they are
+// first locked and removed when nobody holds or waits for them
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+// Lock locks the mutex of a key and returns the function that unlocks it
+func (k *keyedMutex) Lock(key string) func() {
+	k.mutex.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mutex.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		k.mutex.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mutex.Unlock()
+	}
+}
+
+// senders serializes the messages of every sender of the Bots that were not
+// made by NewBot
+var senders = newKeyedMutex()
+
+// lock locks the messages of a sender to the Bot and returns the function that
+// unlocks them, the senders of every Bot are locked apart so that a sender
+// talking to several Bots in a Hub is not serialized across them
+func (b Bot) lock(sender string) func() {
+	if b.senders == nil {
+		return senders.Lock(sender)
+	}
+	return b.senders.Lock(sender)
+}
@@ -0,0 +1,121 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	cmn "github.com/jaimeteb/chatto/common"
+	"github.com/jaimeteb/chatto/fsm"
+	"github.com/jaimeteb/chatto/history"
+	log "github.com/sirupsen/logrus"
+)
+
+// errUnknownCommand is returned when a command to execute for a sender is
+// not in the domain
+var errUnknownCommand = errors.New("unknown command")
+
+// errHandedOff is returned when a command is executed for a sender that is
+// handed off
+var errHandedOff = errors.New("the sender is handed off")
+
+// push sends messages to a recipient through a client and returns them
+func push(msgs interface{}, client Client, recipient string) ([]cmn.Message, error) {
+	messages, err := cmn.MessagesFrom(msgs)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		if err := client.SendMessage(msg, recipient); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+// Notify sends messages to a sender through a channel without the sender
+// messaging first, and then executes a command for the sender and sends its
+// responses, if a command is given. It returns all the messages sent.
+func (b Bot) Notify(ctx context.Context, sender, channel string, msgs interface{}, command string) ([]cmn.Message, error) {
+	client, ok := b.Clients.client(channel)
+	if !ok {
+		return nil, errNoChannel
+	}
+
+	sent := make([]cmn.Message, 0)
+	if msgs != nil {
+		messages, err := push(msgs, client, sender)
+		if err != nil {
+			return nil, err
+		}
+		sent = append(sent, messages...)
+
+		if err := b.offer(ctx, sender, offered(msgs)); err != nil {
+			log.Errorf("Error keeping the choices offered to %v: %v", sender, err)
+		}
+
+		if b.History != nil {
+			entry := history.Entry{
+				Time:      time.Now(),
+				Sender:    sender,
+				Channel:   channel,
+				Responses: messages,
+			}
+			if err := b.History.Add(entry); err != nil {
+				log.Error("Error adding to history:", err)
+			}
+		}
+	}
+
+	if command == "" {
+		return sent, nil
+	}
+	if !b.Domain.HasCommand(command) {
+		return sent, errUnknownCommand
+	}
+	if m, err := b.Machines.Get(ctx, sender); err == nil && m.Handoff {
+		return sent, errHandedOff
+	} else if err != nil && err != fsm.ErrNotFound {
+		return sent, err
+	}
+
+	var messages []cmn.Message
+	_, err := b.process(ctx, cmn.Message{Sender: sender, Command: command}, channel, func(responses interface{}) error {
+		var err error
+		messages, err = push(responses, client, sender)
+		return err
+	})
+	return append(sent, messages...), err
+}
+
+// offer keeps the choices of the messages sent to a sender in its FSM, so
+// that the sender can answer them as it answers the responses of the bot
+func (b Bot) offer(ctx context.Context, sender string, choices []cmn.Button) error {
+	unlock := b.lock(sender)
+	defer unlock()
+
+	for attempt := 1; ; attempt++ {
+		stored, err := b.Machines.Get(ctx, sender)
+		if err == fsm.ErrNotFound {
+			stored = nil
+		} else if err != nil {
+			return err
+		}
+
+		m := &fsm.FSM{State: 0, Slots: make(map[string]string)}
+		if stored != nil {
+			m = stored.Copy()
+		} else if len(choices) == 0 {
+			return nil
+		}
+		m.Choices = choices
+
+		if ok, err := b.Machines.CompareAndSet(ctx, sender, stored, m); err != nil {
+			return err
+		} else if ok {
+			return nil
+		} else if attempt == maxAttempts {
+			return errConflict
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package bot
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadDelay is the time to wait for more file events before reloading,
+// editors usually write a file in several steps
+const reloadDelay = 500 * time.Millisecond
+
+// Watch watches the bot path and reloads the Bot whenever one of its YAML
+// files changes, until the Server is closed
+func (s *Server) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(*s.Path); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !isBotFile(event.Name) {
+					continue
+				}
+				log.Debugf("File changed: %v", event)
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(reloadDelay, func() {
+					s.Reload()
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error(err)
+			case <-s.done:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+		}
+	}()
+
+	log.Infof("Watching %v for changes", *s.Path)
+	return nil
+}
+
+// isBotFile tells if a file is one of the YAML files that define a bot
+func isBotFile(name string) bool {
+	switch filepath.Base(name) {
+	case "bot.yml", "bot.yaml", "chn.yml", "chn.yaml",
+		"clf.yml", "clf.yaml", "fsm.yml", "fsm.yaml":
+		return true
+	}
+	return false
+}
@@ -1,44 +1,192 @@
 package bot
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	cmn "github.com/jaimeteb/chatto/common"
+	"github.com/jaimeteb/chatto/fsm"
+	"github.com/jaimeteb/chatto/history"
+	"github.com/jaimeteb/chatto/metrics"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gorilla/mux"
 )
 
-func (b Bot) restEndpointHandler(w http.ResponseWriter, r *http.Request) {
-	mess, err := b.Clients.REST.RecieveMessage(w, r)
+// Server serves a Bot and swaps it for a new one when its files are reloaded
+type Server struct {
+	Path *string
+
+	bot       Bot
+	inflight  *sync.WaitGroup
+	mutex     sync.RWMutex
+	reloadMu  sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewServer returns a Server for a Bot loaded from path
+func NewServer(path *string, bot Bot) *Server {
+	return &Server{Path: path, bot: bot, inflight: &sync.WaitGroup{}, done: make(chan struct{})}
+}
+
+// Start watches the bot files, runs the timers and prunes the WebSocket
+// sessions of the Bot being served until the Server is closed
+func (s *Server) Start() {
+	if err := s.Watch(); err != nil {
+		log.Warn(err)
+	}
+	go s.RunTimers(time.Second)
+	go s.PruneSessions(time.Minute)
+}
+
+// Close stops watching the bot files and running the timers, and closes the
+// extension, the stores and the handoff of the Bot being served
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.Bot().close()
+	})
+}
+
+// Bot returns the Bot currently being served
+func (s *Server) Bot() Bot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.bot
+}
+
+// acquire returns the Bot currently being served and the function to call
+// once it's no longer used, the extension and the handoff of a Bot that was
+// replaced are only closed after every use of it is released
+func (s *Server) acquire() (Bot, func()) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	s.inflight.Add(1)
+	return s.bot, s.inflight.Done
+}
+
+// Reload loads the bot files again and swaps in the new Bot, the current Bot
+// is kept if any of the files fails to load
+func (s *Server) Reload() (err error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+		if err != nil {
+			log.Errorf("Reload failed, keeping current bot: %v", err)
+		}
+	}()
+
+	newBot, err := s.Bot().Reload(s.Path)
 	if err != nil {
-		log.Error(err)
+		return err
+	}
+
+	s.mutex.Lock()
+	old, inflight := s.bot, s.inflight
+	s.bot, s.inflight = newBot, &sync.WaitGroup{}
+	s.mutex.Unlock()
+
+	// The stores are kept but the extension and the handoff are loaded again,
+	// the old ones are closed once the requests still using them finish
+	go func() {
+		inflight.Wait()
+		if old.Extension != nil {
+			if err := old.Extension.Close(); err != nil {
+				log.Error(err)
+			}
+		}
+		if old.Handoff != nil {
+			if err := old.Handoff.Close(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+
+	log.Info("Reloaded bot")
+	return nil
+}
+
+// handle returns a handler that runs h with the Bot currently being served
+func (s *Server) handle(h func(Bot, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bot, release := s.acquire()
+		defer release()
+		h(bot, w, r)
+	}
+}
+
+func (s *Server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
 
-	resp := b.Answer(mess)
+	js, err := json.Marshal(map[string]bool{"reloaded": true})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	if err := SendMessages(resp, &b.Clients.REST, mess.Sender, w); err != nil {
-		log.Error(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// respond answers a message received through a channel and sends the
+// responses with its client, the transition is rolled back if they are not
+// delivered
+func (b Bot) respond(ctx context.Context, mess cmn.Message, channel string, client Client, w http.ResponseWriter) {
+	if !b.Limits.AllowSender(mess.Sender, time.Now()) {
+		log.Warnf("Rate limit exceeded by %v", mess.Sender)
+		if channel == "rest" {
+			slowDown(b.Limits.SlowDown(), w)
+		} else if err := SendMessages(b.Limits.SlowDown(), client, mess.Sender, w); err != nil {
+			log.Error(err)
+		}
 		return
 	}
+
+	_, err := b.process(ctx, mess, channel, func(responses interface{}) error {
+		return SendMessages(responses, client, mess.Sender, w)
+	})
+	if err == errConflict {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusConflict)
+	} else if err == errDelivery {
+		log.Errorf("Couldn't deliver the answer to %v, keeping its state", mess.Sender)
+	} else if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
-func (b Bot) telegramEndpointHandler(w http.ResponseWriter, r *http.Request) {
-	mess, err := b.Clients.Telegram.RecieveMessage(w, r)
+func (b Bot) restEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	mess, err := b.Clients.REST.RecieveMessage(w, r)
 	if err != nil {
 		log.Error(err)
 		return
 	}
 
-	resp := b.Answer(mess)
+	b.respond(r.Context(), mess, "rest", &b.Clients.REST, w)
+}
 
-	if err := SendMessages(resp, &b.Clients.Telegram, mess.Sender, w); err != nil {
+func (b Bot) telegramEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	mess, err := b.Clients.Telegram.RecieveMessage(w, r)
+	if err != nil {
 		log.Error(err)
 		return
 	}
+
+	b.respond(r.Context(), mess, "telegram", &b.Clients.Telegram, w)
 }
 
 func (b Bot) twilioEndpointHandler(w http.ResponseWriter, r *http.Request) {
@@ -48,36 +196,246 @@ func (b Bot) twilioEndpointHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp := b.Answer(mess)
+	b.respond(r.Context(), mess, "twilio", &b.Clients.Twilio, w)
+}
 
-	if err := SendMessages(resp, &b.Clients.Twilio, mess.Sender, w); err != nil {
+func (b Bot) slackEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	mess, err := b.Clients.Slack.RecieveMessage(w, r)
+	if err != nil {
 		log.Error(err)
 		return
+	} else if mess.Sender == "" {
+		return
 	}
+
+	b.respond(r.Context(), mess, "slack", &b.Clients.Slack, w)
 }
 
-func (b Bot) slackEndpointHandler(w http.ResponseWriter, r *http.Request) {
-	mess, err := b.Clients.Slack.RecieveMessage(w, r)
+func (b Bot) detailsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	senderObj, err := b.Machines.Get(r.Context(), vars["sender"])
+	if err == fsm.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(senderObj)
 	if err != nil {
-		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (b Bot) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	unlock := b.lock(vars["sender"])
+	defer unlock()
+
+	if err := b.Machines.Delete(r.Context(), vars["sender"]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
-	} else if (mess == cmn.Message{}) {
+	}
+
+	js, err := json.Marshal(map[string]bool{"deleted": true})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	resp := b.Answer(mess)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
 
-	if err := SendMessages(resp, &b.Clients.Slack, mess.Sender, w); err != nil {
-		log.Error(err)
+// Senders models a page of senders and the sender to list the next one after
+type Senders struct {
+	Senders []string `json:"senders"`
+	Next    string   `json:"next,omitempty"`
+}
+
+func (b Bot) listHandler(w http.ResponseWriter, r *http.Request) {
+	after := r.URL.Query().Get("after")
+
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			http.Error(w, "invalid limit: "+l, http.StatusBadRequest)
+			return
+		}
+	}
+
+	users, err := b.Machines.List(r.Context(), after, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ans := Senders{Senders: users}
+	if len(users) == limit {
+		ans.Next = users[len(users)-1]
+	}
+
+	js, err := json.Marshal(ans)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
 }
 
-func (b Bot) detailsHandler(w http.ResponseWriter, r *http.Request) {
+func (b Bot) historyHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	senderObj := b.Machines.Get(vars["sender"])
 
-	js, err := json.Marshal(senderObj)
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			http.Error(w, "invalid limit: "+l, http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries := make([]history.Entry, 0)
+	if b.History != nil {
+		var err error
+		if entries, err = b.History.Get(vars["sender"], limit); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	js, err := json.Marshal(entries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (b Bot) handoffHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	handedOff := r.Method != http.MethodDelete
+	var err error
+	if handedOff {
+		err = b.StartHandoff(r.Context(), vars["sender"], r.URL.Query().Get("channel"))
+	} else {
+		err = b.ReleaseHandoff(r.Context(), vars["sender"])
+	}
+	if err == errConflict {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(map[string]bool{"handoff": handedOff})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// AgentReply models the messages an agent sends to a handed off sender and
+// the channel to send them through
+type AgentReply struct {
+	Channel  string      `json:"channel"`
+	Messages interface{} `json:"messages"`
+}
+
+func (b Bot) agentReplyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var reply AgentReply
+	if err := json.NewDecoder(r.Body).Decode(&reply); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := b.Reply(r.Context(), vars["sender"], reply.Channel, reply.Messages)
+	if err == errNotHandedOff {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err == errNoChannel {
+		http.Error(w, err.Error()+": "+reply.Channel, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(map[string]bool{"sent": true})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// Notification models the messages to send to a sender through a channel,
+// and the command to execute for the sender afterwards
+type Notification struct {
+	Channel  string      `json:"channel"`
+	Messages interface{} `json:"messages"`
+	Command  string      `json:"command"`
+}
+
+func (b Bot) notifyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var notification Notification
+	if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if notification.Messages == nil && notification.Command == "" {
+		http.Error(w, "no messages nor command", http.StatusBadRequest)
+		return
+	}
+
+	sent, err := b.Notify(r.Context(), vars["sender"], notification.Channel, notification.Messages, notification.Command)
+	switch err {
+	case nil:
+	case errNoChannel:
+		http.Error(w, err.Error()+": "+notification.Channel, http.StatusBadRequest)
+		return
+	case errUnknownCommand:
+		http.Error(w, err.Error()+": "+notification.Command, http.StatusBadRequest)
+		return
+	case errHandedOff, errConflict:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errDelivery:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ans := make([]map[string]interface{}, 0, len(sent))
+	for _, msg := range sent {
+		ans = append(ans, msg.Out())
+	}
+
+	js, err := json.Marshal(ans)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -99,7 +457,8 @@ func (b Bot) predictHandler(w http.ResponseWriter, r *http.Request) {
 
 	inputText := mess.Text
 	prediction, prob := b.Classifier.Predict(inputText)
-	ans := Prediction{inputText, prediction, prob}
+	entities := b.Domain.Extractors.Extract(inputText)
+	ans := Prediction{inputText, prediction, prob, entities}
 
 	js, err := json.Marshal(ans)
 	if err != nil {
@@ -111,24 +470,69 @@ func (b Bot) predictHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(js)
 }
 
+// Router returns a router with the endpoints of the Bot being served, the
+// endpoint label of their metrics starts with prefix. The REST and WebSocket
+// endpoints require the chat credentials of the Bot and the other ones,
+// except for the channels, its admin credentials.
+func (s *Server) Router(prefix string) *mux.Router {
+	r := mux.NewRouter()
+
+	chat := func(h http.Handler) http.Handler {
+		return s.guard(func(b Bot) Credentials { return b.Auth.Chat }, h)
+	}
+	admin := func(h http.Handler) http.Handler {
+		return s.guard(func(b Bot) Credentials { return b.Auth.Admin }, h)
+	}
+
+	// Integration Endpoints
+	r.Handle("/endpoints/rest", metrics.Instrument(prefix+"rest", chat(s.handle(Bot.restEndpointHandler)))).Methods("POST", "OPTIONS")
+	r.Handle("/endpoints/telegram", metrics.Instrument(prefix+"telegram", s.handle(Bot.telegramEndpointHandler))).Methods("POST")
+	r.Handle("/endpoints/twilio", metrics.Instrument(prefix+"twilio", s.handle(Bot.twilioEndpointHandler))).Methods("POST")
+	r.Handle("/endpoints/slack", metrics.Instrument(prefix+"slack", s.handle(Bot.slackEndpointHandler))).Methods("POST")
+	r.Handle("/endpoints/ws", metrics.Instrument(prefix+"ws", chat(http.HandlerFunc(s.wsEndpointHandler)))).Methods("GET")
+	r.Handle("/endpoints/ws", metrics.Instrument(prefix+"ws_post", chat(s.handle(Bot.wsPostHandler)))).Methods("POST", "OPTIONS")
+
+	// Prediction and Sender Endpoints
+	r.Handle("/predict", metrics.Instrument(prefix+"predict", admin(s.handle(Bot.predictHandler)))).Methods("POST", "OPTIONS")
+	r.Handle("/senders", metrics.Instrument(prefix+"list", admin(s.handle(Bot.listHandler)))).Methods("GET", "OPTIONS")
+	r.Handle("/senders/{sender}", metrics.Instrument(prefix+"senders", admin(s.handle(Bot.detailsHandler)))).Methods("GET", "OPTIONS")
+	r.Handle("/senders/{sender}", metrics.Instrument(prefix+"delete", admin(s.handle(Bot.deleteHandler)))).Methods("DELETE")
+	r.Handle("/senders/{sender}/history", metrics.Instrument(prefix+"history", admin(s.handle(Bot.historyHandler)))).Methods("GET", "OPTIONS")
+	r.Handle("/senders/{sender}/messages", metrics.Instrument(prefix+"notify", admin(s.handle(Bot.notifyHandler)))).Methods("POST", "OPTIONS")
+
+	// Handoff Endpoints
+	r.Handle("/senders/{sender}/handoff", metrics.Instrument(prefix+"handoff", admin(s.handle(Bot.handoffHandler)))).Methods("POST", "DELETE", "OPTIONS")
+	r.Handle("/senders/{sender}/handoff/messages", metrics.Instrument(prefix+"agent", admin(s.handle(Bot.agentReplyHandler)))).Methods("POST", "OPTIONS")
+
+	// Admin Endpoints
+	r.Handle("/admin/reload", metrics.Instrument(prefix+"reload", admin(http.HandlerFunc(s.reloadHandler)))).Methods("POST", "OPTIONS")
+
+	return r
+}
+
 // ServeBot function
 func ServeBot(path *string, port *int) {
-	bot := LoadBot(path)
+	server := NewServer(path, LoadBot(path))
+	server.Start()
 
 	// log.Info("\n" + LOGO)
 	log.Info("Server started")
 
-	r := mux.NewRouter()
+	r := server.Router("")
 
-	// Integration Endpoints
-	r.HandleFunc("/endpoints/rest", bot.restEndpointHandler).Methods("POST")
-	r.HandleFunc("/endpoints/telegram", bot.telegramEndpointHandler).Methods("POST")
-	r.HandleFunc("/endpoints/twilio", bot.twilioEndpointHandler).Methods("POST")
-	r.HandleFunc("/endpoints/slack", bot.slackEndpointHandler).Methods("POST")
+	err := metrics.RegisterSenders(func() int {
+		count, err := server.Bot().Machines.Count(context.Background())
+		if err != nil {
+			log.Error("Error counting senders:", err)
+		}
+		return count
+	}, metrics.SendersInterval)
+	if err != nil {
+		log.Warn(err)
+	}
 
-	// Prediction and Sender Endpoints
-	r.HandleFunc("/predict", bot.predictHandler).Methods("POST")
-	r.HandleFunc("/senders/{sender}", bot.detailsHandler).Methods("GET")
+	// Metrics Endpoint
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
 
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", *port), r))
 }
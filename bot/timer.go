@@ -0,0 +1,112 @@
+package bot
+
+import (
+	"context"
+	"time"
+
+	"github.com/jaimeteb/chatto/fsm"
+	"github.com/jaimeteb/chatto/history"
+	log "github.com/sirupsen/logrus"
+)
+
+// schedule replaces the timers of a sender with the ones for the timeouts of
+// the state of its FSM
+func (b Bot) schedule(ctx context.Context, sender, channel string, m *fsm.FSM) {
+	timers := b.Domain.Timers(sender, channel, m, time.Now())
+	if err := b.Machines.Schedule(ctx, sender, timers); err != nil {
+		log.Errorf("Error scheduling the timeouts of %v: %v", sender, err)
+	}
+}
+
+// fire executes the timeout of a due timer and sends its message through the
+// channel of the timer, the timeout is ignored if the sender is no longer in
+// the state of the timer
+func (b Bot) fire(ctx context.Context, timer fsm.Timer) error {
+	unlock := b.lock(timer.User)
+	defer unlock()
+
+	stored, err := b.Machines.Get(ctx, timer.User)
+	if err == fsm.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	m := stored.Copy()
+	resp, ok := m.ExecuteTimeout(timer, b.Domain)
+	if !ok {
+		return nil
+	}
+	client, found := b.Clients.client(timer.Channel)
+	if resp != nil && found {
+		m.Choices = offered(resp)
+	}
+	if ok, err := b.Machines.CompareAndSet(ctx, timer.User, stored, m); err != nil || !ok {
+		return err
+	}
+
+	r := &reply{
+		Sender:    timer.User,
+		Responses: []interface{}{},
+		Stored:    stored,
+		FSM:       m,
+		Entry: history.Entry{
+			Sender:  timer.User,
+			Channel: timer.Channel,
+			From:    b.Domain.StateName(stored.State),
+			Into:    b.Domain.StateName(m.State),
+		},
+	}
+
+	if resp != nil {
+		if found {
+			if _, err := push(resp, client, timer.User); err != nil {
+				b.rollback(ctx, r)
+				return err
+			}
+			r.Responses = resp
+		} else {
+			log.Debugf("Can't send the timeout message of %v through channel '%v'", timer.User, timer.Channel)
+		}
+	}
+
+	if m.State != stored.State {
+		b.schedule(ctx, timer.User, timer.Channel, m)
+	}
+	b.record(r)
+	return nil
+}
+
+// RunTimers fires the due timers of the Bot being served every interval,
+// until the Server is closed
+func (s *Server) RunTimers(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		s.fireDue(context.Background())
+	}
+}
+
+// fireDue fires the timers of the Bot being served that are due
+func (s *Server) fireDue(ctx context.Context) {
+	bot, release := s.acquire()
+	defer release()
+
+	timers, err := bot.Machines.Due(ctx, time.Now())
+	if err != nil {
+		log.Error("Error getting due timers:", err)
+		return
+	}
+	for _, timer := range timers {
+		if err := bot.fire(ctx, timer); err != nil {
+			log.Errorf("Error firing the timeout of %v: %v", timer.User, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package bot
+
+import (
+	"strings"
+
+	"github.com/jaimeteb/chatto/clf"
+	cmn "github.com/jaimeteb/chatto/common"
+	"github.com/jaimeteb/chatto/ext"
+	"github.com/jaimeteb/chatto/fsm"
+)
+
+// Validate loads the bot files in path and checks each of them, as well as
+// the consistency between the classifier, the FSM and the extensions
+func Validate(path *string) cmn.Validation {
+	var v cmn.Validation
+
+	bc, err := ReadBotConfig(path)
+	if err != nil {
+		v.Errorf("bot.yml: %v", err)
+	}
+
+	if end, err := LoadClientsConfig(path); err != nil {
+		v.Errorf("chn.yml: %v", err)
+	} else if end.Twilio != (TwilioConfig{}) && end.Twilio.WebhookURL == "" {
+		v.Errorf("chn.yml: %v", errTwilioWebhook)
+	}
+
+	fsmConfig, err := fsm.LoadConfig(path)
+	if err != nil {
+		v.Errorf("fsm.yml: %v", err)
+		return v
+	}
+	v.Add("fsm.yml", fsmConfig.Validate())
+
+	classification, err := clf.LoadConfig(path)
+	if err != nil {
+		v.Errorf("clf.yml: %v", err)
+		return v
+	}
+	if _, err := clf.NewClassifier(classification); err != nil {
+		v.Errorf("clf.yml: %v", err)
+	}
+
+	commands := make(map[string]bool)
+	for _, function := range fsmConfig.Functions {
+		commands[function.Command] = true
+	}
+	for _, class := range classification.Classification {
+		if !commands[class.Command] {
+			v.Warnf("clf.yml: command '%v' is never used by the FSM", class.Command)
+		}
+	}
+
+	extNames := extNames(fsmConfig)
+	if len(extNames) == 0 {
+		return v
+	}
+
+	var allFuncs []string
+	if extension := ext.LoadExtensions(bc.Extensions); extension != nil {
+		allFuncs = extension.GetAllFuncs()
+		extension.Close()
+	}
+	if len(allFuncs) == 0 {
+		v.Warnf("bot.yml: no extension server available, skipping extension checks")
+		return v
+	}
+
+	funcs := make(map[string]bool)
+	for _, fun := range allFuncs {
+		funcs[fun] = true
+	}
+	for _, name := range extNames {
+		if !funcs[name] {
+			v.Errorf("fsm.yml: extension function '%v' not found in the extension server", name)
+		}
+	}
+
+	return v
+}
+
+// extNames returns the names of the extension functions used in the FSM
+func extNames(config fsm.Config) []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	messages := make([]interface{}, 0)
+	for _, function := range config.Functions {
+		messages = append(messages, function.Message)
+	}
+	for _, form := range config.Forms {
+		messages = append(messages, form.Message)
+	}
+
+	for _, message := range messages {
+		name, ok := message.(string)
+		if ok && strings.HasPrefix(name, "ext_") && !seen[name] {
+			names = append(names, name)
+			seen[name] = true
+		}
+	}
+	return names
+}
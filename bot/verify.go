@@ -0,0 +1,111 @@
+package bot
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// errSignature is returned when a webhook request is not signed by its channel
+var errSignature = errors.New("invalid webhook signature")
+
+// errTwilioWebhook is returned when the Twilio requests can't be verified
+// because there is no webhook URL
+var errTwilioWebhook = errors.New("twilio requires webhook_url to verify its requests")
+
+// slackMaxAge is how old a signed Slack request can be, older requests are
+// rejected as replays
+const slackMaxAge = 5 * time.Minute
+
+// readBody returns the body of a request and restores it so that it can be
+// read again
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// verifySlack checks the signature of a Slack request made with the signing
+// secret of the app, and that it was made recently
+func verifySlack(r *http.Request, secret string, now time.Time) error {
+	ts := r.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errSignature
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > slackMaxAge || age < -slackMaxAge {
+		return errSignature
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + ts + ":"))
+	mac.Write(body)
+	signature := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(signature), []byte(r.Header.Get("X-Slack-Signature"))) {
+		return errSignature
+	}
+	return nil
+}
+
+// verifyTwilio checks the signature of a Twilio request made with the auth
+// token of the account, for the public URL of the endpoint
+func verifyTwilio(r *http.Request, authToken, webhookURL string) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	params, err := url.ParseQuery(string(body))
+	if err != nil {
+		return errSignature
+	}
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(webhookURL))
+	for _, key := range keys {
+		for _, value := range params[key] {
+			mac.Write([]byte(key + value))
+		}
+	}
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(signature), []byte(r.Header.Get("X-Twilio-Signature"))) {
+		return errSignature
+	}
+	return nil
+}
+
+// verifyTelegram checks that a Telegram request has the secret token the
+// webhook was set with
+func verifyTelegram(r *http.Request, secretToken string) error {
+	token := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secretToken)) != 1 {
+		return errSignature
+	}
+	return nil
+}
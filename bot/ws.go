@@ -0,0 +1,430 @@
+package bot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	cmn "github.com/jaimeteb/chatto/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// WSConfig models the WebSocket channel configuration, Replay is the number
+// of messages kept for each session to send again when it reconnects and
+// SessionTTL the seconds a session is kept without connections
+type WSConfig struct {
+	Replay     int `mapstructure:"replay"`
+	SessionTTL int `mapstructure:"session_ttl"`
+}
+
+// Default WebSocket channel configuration
+const (
+	defaultWSReplay     = 50
+	defaultWSSessionTTL = time.Hour
+)
+
+// Limits of the connections, a connection is closed if it doesn't answer the
+// pings sent every wsPingPeriod within wsPongWait, or if it sends a frame
+// larger than wsReadLimit bytes
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPongWait     = time.Minute
+	wsPingPeriod   = wsPongWait * 9 / 10
+	wsReadLimit    = 64 * 1024
+)
+
+// wsProtocol is the subprotocol of the WebSocket channel, clients that send a
+// token as a subprotocol prefixed with wsBearer have to request it too
+const (
+	wsProtocol = "chatto"
+	wsBearer   = "bearer."
+)
+
+// Types of the frames of the WebSocket channel
+const (
+	// wsSession is sent when a connection is opened, with its session
+	wsSession = "session"
+	// wsMessage carries a message, either way
+	wsMessage = "message"
+	// wsTyping tells if the bot is answering a message
+	wsTyping = "typing"
+)
+
+// wsFrame models a frame of the WebSocket channel, the messages sent to a
+// session are numbered with Seq
+type wsFrame struct {
+	Type    string                 `json:"type"`
+	Session string                 `json:"session,omitempty"`
+	Seq     int                    `json:"seq,omitempty"`
+	Typing  *bool                  `json:"typing,omitempty"`
+	Message map[string]interface{} `json:"message,omitempty"`
+}
+
+// errUnknownSession is returned when a message is sent to a session that
+// doesn't exist or has expired
+var errUnknownSession = errors.New("unknown WebSocket session")
+
+// sessionID matches the session IDs, which are the senders of the channel
+var sessionID = regexp.MustCompile(`^ws-[0-9a-f]{32}$`)
+
+// WSClient sends messages to the browser sessions connected to the
+// WebSocket channel, the messages sent to a session are kept for a while so
+// that they can be sent again if it reconnects
+type WSClient struct {
+	Replay     int
+	SessionTTL time.Duration
+
+	sessions *wsSessions
+}
+
+type wsSessions struct {
+	mutex    sync.Mutex
+	sessions map[string]*wsSessionState
+}
+
+type wsSessionState struct {
+	conns map[*wsConn]bool
+	sent  []wsFrame
+	seq   int
+	seen  time.Time
+}
+
+// wsConn serializes the writes to a connection
+type wsConn struct {
+	mutex sync.Mutex
+	conn  *websocket.Conn
+}
+
+func (c *wsConn) write(frame wsFrame) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.writeLocked(frame)
+}
+
+func (c *wsConn) writeLocked(frame wsFrame) error {
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteJSON(frame)
+}
+
+// NewWSClient returns a WSClient without sessions
+func NewWSClient(wc WSConfig) WSClient {
+	replay, ttl := defaultWSReplay, defaultWSSessionTTL
+	if wc.Replay > 0 {
+		replay = wc.Replay
+	}
+	if wc.SessionTTL > 0 {
+		ttl = time.Duration(wc.SessionTTL) * time.Second
+	}
+	return WSClient{replay, ttl, &wsSessions{sessions: make(map[string]*wsSessionState)}}
+}
+
+// SendMessage for WebSocket, the message is kept for replay if the session
+// isn't connected
+func (c *WSClient) SendMessage(msg cmn.Message, recipient string) error {
+	s := c.sessions
+	if s == nil {
+		return errUnknownSession
+	}
+	s.mutex.Lock()
+	session, ok := s.sessions[recipient]
+	if !ok {
+		s.mutex.Unlock()
+		return errUnknownSession
+	}
+	session.seq++
+	frame := wsFrame{Type: wsMessage, Seq: session.seq, Message: msg.Out()}
+	session.sent = append(session.sent, frame)
+	if len(session.sent) > c.Replay {
+		session.sent = session.sent[len(session.sent)-c.Replay:]
+	}
+	conns := session.connections()
+	s.mutex.Unlock()
+
+	for _, conn := range conns {
+		if err := conn.write(frame); err != nil {
+			log.Debugf("Couldn't write to a connection of %v: %v", recipient, err)
+		}
+	}
+	return nil
+}
+
+// RecieveMessage for WebSocket, a message of a session can also be posted,
+// for example while it reconnects, its responses are sent to the session
+func (c *WSClient) RecieveMessage(w http.ResponseWriter, r *http.Request) (cmn.Message, error) {
+	decoder := json.NewDecoder(r.Body)
+	var mess cmn.Message
+
+	if err := decoder.Decode(&mess); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return cmn.Message{}, err
+	}
+
+	if !c.has(mess.Sender) {
+		http.Error(w, errUnknownSession.Error(), http.StatusNotFound)
+		return cmn.Message{}, errUnknownSession
+	}
+
+	return mess, nil
+}
+
+// has tells if a session exists
+func (c *WSClient) has(session string) bool {
+	if c.sessions == nil {
+		return false
+	}
+	c.sessions.mutex.Lock()
+	defer c.sessions.mutex.Unlock()
+	_, ok := c.sessions.sessions[session]
+	return ok
+}
+
+// typing tells the connections of a session if the bot is answering
+func (c *WSClient) typing(session string, typing bool) {
+	c.sessions.mutex.Lock()
+	var conns []*wsConn
+	if s, ok := c.sessions.sessions[session]; ok {
+		conns = s.connections()
+	}
+	c.sessions.mutex.Unlock()
+
+	for _, conn := range conns {
+		if err := conn.write(wsFrame{Type: wsTyping, Typing: &typing}); err != nil {
+			log.Debugf("Couldn't write to a connection of %v: %v", session, err)
+		}
+	}
+}
+
+// prune removes the sessions that have had no connections for longer than
+// their TTL
+func (c *WSClient) prune(now time.Time) {
+	if c.sessions == nil {
+		return
+	}
+	c.sessions.mutex.Lock()
+	defer c.sessions.mutex.Unlock()
+
+	for id, session := range c.sessions.sessions {
+		if len(session.conns) == 0 && now.Sub(session.seen) > c.SessionTTL {
+			delete(c.sessions.sessions, id)
+		}
+	}
+}
+
+// connect adds a connection to a session, a new one if the ID is not valid,
+// and sends it the session and the messages after last
+func (c *WSClient) connect(id string, last int, conn *websocket.Conn) (string, *wsConn, error) {
+	s := c.sessions
+	now := time.Now()
+
+	s.mutex.Lock()
+	if !sessionID.MatchString(id) {
+		var err error
+		if id, err = newSessionID(); err != nil {
+			s.mutex.Unlock()
+			return "", nil, err
+		}
+	}
+	session, ok := s.sessions[id]
+	if !ok {
+		session = &wsSessionState{conns: make(map[*wsConn]bool)}
+		s.sessions[id] = session
+	}
+
+	wc := &wsConn{conn: conn}
+	session.conns[wc] = true
+	session.seen = now
+	seq := session.seq
+	replay := make([]wsFrame, 0)
+	for _, frame := range session.sent {
+		if frame.Seq > last {
+			replay = append(replay, frame)
+		}
+	}
+
+	// Hold the connection until the replay is written so that it goes before
+	// the messages sent meanwhile
+	wc.mutex.Lock()
+	defer wc.mutex.Unlock()
+	s.mutex.Unlock()
+
+	if err := wc.writeLocked(wsFrame{Type: wsSession, Session: id, Seq: seq}); err != nil {
+		return id, wc, err
+	}
+	for _, frame := range replay {
+		if err := wc.writeLocked(frame); err != nil {
+			return id, wc, err
+		}
+	}
+	return id, wc, nil
+}
+
+// disconnect removes a connection from its session
+func (c *WSClient) disconnect(id string, wc *wsConn) {
+	c.sessions.mutex.Lock()
+	defer c.sessions.mutex.Unlock()
+
+	if session, ok := c.sessions.sessions[id]; ok {
+		delete(session.conns, wc)
+		session.seen = time.Now()
+	}
+}
+
+func (s *wsSessionState) connections() []*wsConn {
+	conns := make([]*wsConn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// newSessionID returns a random session ID
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "ws-" + hex.EncodeToString(b), nil
+}
+
+// PruneSessions removes the expired WebSocket sessions of the Bot being
+// served every interval, until the Server is closed
+func (s *Server) PruneSessions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			ws := s.Bot().Clients.WS
+			ws.prune(now)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// checkOrigin allows the connections from the same host and from the
+// origins allowed by the CORS configuration of the Bot
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	allowed := s.Bot().CORS.AllowedOrigins
+	return contains(allowed, origin) || contains(allowed, "*")
+}
+
+// wsEndpointHandler opens a WebSocket connection for the session in the
+// query, or a new one, and answers the messages received through it. The
+// messages after the "last" one in the query are sent again.
+func (s *Server) wsEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	ws := s.Bot().Clients.WS
+	if ws.sessions == nil {
+		http.Error(w, "the WebSocket channel is not available", http.StatusNotFound)
+		return
+	}
+
+	upgrader := websocket.Upgrader{CheckOrigin: s.checkOrigin, Subprotocols: []string{wsProtocol}}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	last, _ := strconv.Atoi(r.URL.Query().Get("last"))
+	session, wc, err := ws.connect(r.URL.Query().Get("session"), last, conn)
+	if wc != nil {
+		defer ws.disconnect(session, wc)
+	}
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	conn.SetReadLimit(wsReadLimit)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		ticker := time.NewTicker(wsPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+					conn.Close()
+					return
+				}
+			case <-s.done:
+				conn.Close()
+				return
+			case <-closed:
+				return
+			}
+		}
+	}()
+
+	for {
+		var frame wsFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Debugf("Closing a connection of %v: %v", session, err)
+			}
+			return
+		}
+		if frame.Type != wsMessage {
+			continue
+		}
+
+		mess := cmn.MessageFromMap(frame.Message)
+		mess.Sender = session
+
+		bot, release := s.acquire()
+		if !bot.Limits.AllowSender(session, time.Now()) {
+			release()
+			log.Warnf("Rate limit exceeded by %v", session)
+			if _, err := push(bot.Limits.SlowDown(), &ws, session); err != nil {
+				log.Error(err)
+			}
+			continue
+		}
+
+		ws.typing(session, true)
+		_, err := bot.process(context.Background(), mess, "ws", func(responses interface{}) error {
+			_, err := push(responses, &ws, session)
+			return err
+		})
+		ws.typing(session, false)
+		release()
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+func (b Bot) wsPostHandler(w http.ResponseWriter, r *http.Request) {
+	mess, err := b.Clients.WS.RecieveMessage(w, r)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	b.respond(r.Context(), mess, "ws", &b.Clients.WS, w)
+}
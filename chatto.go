@@ -1,10 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"os"
+	"strings"
 
+	"github.com/fatih/color"
 	"github.com/jaimeteb/chatto/bot"
+	"github.com/jaimeteb/chatto/clf"
 	cmn "github.com/jaimeteb/chatto/common"
+	log "github.com/sirupsen/logrus"
 )
 
 func init() {
@@ -15,10 +22,108 @@ func main() {
 	cli := flag.Bool("cli", false, "Run in CLI mode.")
 	port := flag.Int("port", 4770, "Specify port to use.")
 	path := flag.String("path", ".", "Path to YAML files.")
-	flag.Parse()
+	bots := flag.String("bots", "", "Directory with a bot in every subdirectory, or manifest file, to serve several bots.")
+	folds := flag.Int("folds", 5, "Number of folds for cross-validation in eval mode.")
+	test := flag.String("test", "", "Test file to score in eval mode, with the same format as clf.yml.")
+	jsonOut := flag.Bool("json", false, "Print the results of eval mode as JSON.")
 
-	if *cli {
-		go bot.CLI(port)
+	// The first argument can be a command, the default one is to serve the bot
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
-	bot.ServeBot(path, port)
+	flag.CommandLine.Parse(args)
+
+	switch command {
+	case "serve":
+		if *bots != "" {
+			bot.ServeBots(bots, port)
+			break
+		}
+		if *cli {
+			go bot.CLI(port)
+		}
+		bot.ServeBot(path, port)
+	case "validate":
+		os.Exit(validate(path))
+	case "eval":
+		os.Exit(eval(path, *folds, *test, *jsonOut))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command '%v', use one of: serve, validate, eval\n", command)
+		os.Exit(2)
+	}
+}
+
+// validate prints the errors and warnings found in the bot files and returns
+// the exit code
+func validate(path *string) int {
+	validation := bot.Validate(path)
+
+	for _, warning := range validation.Warnings {
+		color.Yellow("WARNING: %v", warning)
+	}
+	for _, err := range validation.Errors {
+		color.Red("ERROR:   %v", err)
+	}
+	fmt.Printf("%v error(s), %v warning(s)\n", len(validation.Errors), len(validation.Warnings))
+
+	if len(validation.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// eval prints the cross-validation scores of the classifier, and the scores
+// over a test file if there is one, and returns the exit code
+func eval(path *string, folds int, test string, jsonOut bool) int {
+	log.SetLevel(log.WarnLevel)
+
+	classification, err := clf.LoadConfig(path)
+	if err != nil {
+		color.Red("ERROR: %v", err)
+		return 1
+	}
+
+	evaluations := make(map[string]clf.Evaluation)
+
+	cv, err := clf.CrossValidate(classification, folds)
+	if err != nil {
+		color.Red("ERROR: %v", err)
+		return 1
+	}
+	evaluations["cross_validation"] = cv
+
+	if test != "" {
+		testClassification, err := clf.LoadConfigFile(test)
+		if err != nil {
+			color.Red("ERROR: %v", err)
+			return 1
+		}
+		ev, err := clf.Evaluate(classification, testClassification.Classification)
+		if err != nil {
+			color.Red("ERROR: %v", err)
+			return 1
+		}
+		evaluations["test"] = ev
+	}
+
+	if jsonOut {
+		js, err := json.MarshalIndent(evaluations, "", "  ")
+		if err != nil {
+			color.Red("ERROR: %v", err)
+			return 1
+		}
+		fmt.Println(string(js))
+		return 0
+	}
+
+	color.Cyan("Cross-validation")
+	cv.Print(os.Stdout)
+	if ev, ok := evaluations["test"]; ok {
+		fmt.Println()
+		color.Cyan("Test file: %v", test)
+		ev.Print(os.Stdout)
+	}
+	return 0
 }
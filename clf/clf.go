@@ -0,0 +1,145 @@
+package clf
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/spf13/viper"
+)
+
+// Classification models a classification yaml file
+type Classification struct {
+	Classification []TrainingTexts `yaml:"classification"`
+	Pipeline       PipelineConfig  `yaml:"pipeline"`
+}
+
+// TrainingTexts models texts used for training the classifier
+type TrainingTexts struct {
+	Command string   `yaml:"command"`
+	Texts   []string `yaml:"texts"`
+}
+
+// Classifier interface models a classifier that can be trained with texts
+// and predicts a command for a given text. Classify returns the most likely
+// command, its probability and whether it meets the threshold of the
+// pipeline, Predict only returns it if it does and no command and -1 if not.
+type Classifier interface {
+	Learn(texts []TrainingTexts) error
+	Classify(text string) (string, float64, bool)
+	Predict(text string) (string, float64)
+}
+
+// predict returns the command a Classifier classifies a text as if it meets
+// the threshold
+func predict(c Classifier, text string) (string, float64) {
+	class, prob, sure := c.Classify(text)
+	if !sure {
+		return "", -1.0
+	}
+	return class, prob
+}
+
+// Load loads classification configuration from yaml
+func Load(path *string) Classification {
+	botClassif, err := LoadConfig(path)
+	if err != nil {
+		log.Panic(err)
+	}
+	return botClassif
+}
+
+// LoadConfig loads classification configuration from yaml and returns an error if it fails
+func LoadConfig(path *string) (Classification, error) {
+	config := viper.New()
+	config.SetConfigName("clf")
+	config.AddConfigPath(*path)
+
+	return readConfig(config)
+}
+
+// LoadConfigFile loads classification configuration from a yaml file with any
+// name, such as a test file, and returns an error if it fails
+func LoadConfigFile(file string) (Classification, error) {
+	config := viper.New()
+	config.SetConfigFile(file)
+
+	return readConfig(config)
+}
+
+func readConfig(config *viper.Viper) (Classification, error) {
+	var botClassif Classification
+	if err := config.ReadInConfig(); err != nil {
+		return botClassif, err
+	}
+
+	if err := config.Unmarshal(&botClassif); err != nil {
+		return botClassif, err
+	}
+
+	return botClassif, nil
+}
+
+// Create returns a trained Classifier
+func Create(path *string) Classifier {
+	classifier, err := NewClassifier(Load(path))
+	if err != nil {
+		log.Panic(err)
+	}
+	return classifier
+}
+
+// NewClassifier returns the Classifier selected in the pipeline, trained
+// with the given classification
+func NewClassifier(classification Classification) (Classifier, error) {
+	pipeline := classification.Pipeline
+
+	if pipeline.Classifier == "" {
+		pipeline.Classifier = "naive_bayes"
+	}
+
+	classifier, err := newClassifier(pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, class := range classification.Classification {
+		if seen[class.Command] {
+			return nil, fmt.Errorf("command '%v' is classified more than once", class.Command)
+		}
+		seen[class.Command] = true
+	}
+	if len(seen) < 2 {
+		return nil, errors.New("at least two commands are needed for classification")
+	}
+
+	log.Info("Pipeline:")
+	log.Infof("* Classifier: \t%v\n", pipeline.Classifier)
+	log.Infof("* RemoveSymbols: \t%v\n", pipeline.RemoveSymbols)
+	log.Infof("* Lower: \t\t%v\n", pipeline.Lower)
+	log.Infof("* Threshold: \t%v\n", pipeline.Threshold)
+
+	if err := classifier.Learn(classification.Classification); err != nil {
+		return nil, err
+	}
+
+	log.Info("Loaded commands for classifier:")
+	for i, class := range classification.Classification {
+		log.Infof("%v\t%v\n", i, class.Command)
+	}
+
+	return classifier, nil
+}
+
+// newClassifier returns an untrained Classifier of the type in the pipeline
+func newClassifier(pipeline PipelineConfig) (Classifier, error) {
+	switch pipeline.Classifier {
+	case "", "naive_bayes":
+		return NewNaiveBayesClassifier(pipeline), nil
+	case "tfidf":
+		return NewTFIDFClassifier(pipeline), nil
+	}
+	return nil, fmt.Errorf("unknown classifier '%v'", pipeline.Classifier)
+}
@@ -15,6 +15,9 @@ func TestClf1(t *testing.T) {
 	if pred2 != "" {
 		t.Errorf("pred is incorrect, got: %v, want: %v.", pred2, "")
 	}
+	if class, prob, sure := classif.Classify("foo"); class == "" || prob < 0 || sure {
+		t.Errorf("pred is incorrect, got: %v (%v, %v), want: %v.", class, prob, sure, "a class under the threshold")
+	}
 }
 
 func TestClf2(t *testing.T) {
@@ -26,3 +29,93 @@ func TestClf2(t *testing.T) {
 	}()
 	Create(&path)
 }
+
+func TestTFIDF(t *testing.T) {
+	path := "../examples/02_misc/"
+	classification := Load(&path)
+	classification.Pipeline.Classifier = "tfidf"
+
+	classif, err := NewClassifier(classification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pred1, prob1 := classif.Predict("tell me a joke")
+	if pred1 != "joke" || prob1 < 0.99 {
+		t.Errorf("pred is incorrect, got: %v (%v), want: %v.", pred1, prob1, "joke")
+	}
+	pred2, _ := classif.Predict("what's the weather like in Paris?")
+	if pred2 != "weather" {
+		t.Errorf("pred is incorrect, got: %v, want: %v.", pred2, "weather")
+	}
+	pred3, _ := classif.Predict("foo bar")
+	if pred3 != "" {
+		t.Errorf("pred is incorrect, got: %v, want: %v.", pred3, "")
+	}
+}
+
+func TestNewClassifierErrors(t *testing.T) {
+	classification := Classification{
+		Classification: []TrainingTexts{
+			{Command: "foo", Texts: []string{"foo"}},
+			{Command: "bar", Texts: []string{"bar"}},
+		},
+		Pipeline: PipelineConfig{Classifier: "svm"},
+	}
+	if _, err := NewClassifier(classification); err == nil {
+		t.Error("incorrect, want: error for unknown classifier")
+	}
+
+	classification.Pipeline.Classifier = ""
+	classification.Classification = classification.Classification[:1]
+	if _, err := NewClassifier(classification); err == nil {
+		t.Error("incorrect, want: error for a single command")
+	}
+}
+
+func TestCrossValidate(t *testing.T) {
+	path := "../examples/04_trivia/"
+	classification := Load(&path)
+
+	evaluation, err := CrossValidate(classification, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evaluation.Samples != 11 {
+		t.Errorf("incorrect, got: %v, want: %v.", evaluation.Samples, 11)
+	}
+
+	total := 0
+	for _, row := range evaluation.Confusion {
+		for _, n := range row {
+			total += n
+		}
+	}
+	if total != evaluation.Samples {
+		t.Errorf("incorrect, got: %v, want: %v.", total, evaluation.Samples)
+	}
+
+	if _, err := CrossValidate(classification, 1); err == nil {
+		t.Error("incorrect, want: error for a single fold")
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	path := "../examples/00_test/"
+	classification := Load(&path)
+	classification.Pipeline.Threshold = 1.1
+
+	evaluation, err := Evaluate(classification, classification.Classification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evaluation.Accuracy != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", evaluation.Accuracy, 0)
+	}
+	if evaluation.Threshold.AccuracyWithout != 1 {
+		t.Errorf("incorrect, got: %v, want: %v.", evaluation.Threshold.AccuracyWithout, 1)
+	}
+	if evaluation.Threshold.Rejected != evaluation.Samples {
+		t.Errorf("incorrect, got: %v, want: %v.", evaluation.Threshold.Rejected, evaluation.Samples)
+	}
+}
@@ -0,0 +1,250 @@
+package clf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// Unsure is the label used for texts that could not be classified
+const Unsure = "(unsure)"
+
+// Evaluation models the scores of a classifier over a set of labeled texts
+type Evaluation struct {
+	Folds     int                       `json:"folds,omitempty"`
+	Samples   int                       `json:"samples"`
+	Accuracy  float64                   `json:"accuracy"`
+	Commands  map[string]Score          `json:"commands"`
+	Confusion map[string]map[string]int `json:"confusion"`
+	Threshold ThresholdEffect           `json:"threshold"`
+}
+
+// Score models the precision, recall and F1 score of a command
+type Score struct {
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+	F1        float64 `json:"f1"`
+	Support   int     `json:"support"`
+}
+
+// ThresholdEffect models how the pipeline threshold changes the predictions
+type ThresholdEffect struct {
+	Threshold       float64 `json:"threshold"`
+	Rejected        int     `json:"rejected"`
+	RejectedCorrect int     `json:"rejected_correct"`
+	AccuracyWithout float64 `json:"accuracy_without"`
+	UnsureWith      int     `json:"unsure_with"`
+	UnsureWithout   int     `json:"unsure_without"`
+}
+
+// result models the prediction for a single labeled text
+type result struct {
+	Actual    string
+	Predicted string
+	Prob      float64
+}
+
+// CrossValidate evaluates a classification with k-fold cross-validation, the
+// texts of every command are distributed evenly among the folds
+func CrossValidate(classification Classification, folds int) (Evaluation, error) {
+	if folds < 2 {
+		return Evaluation{}, errors.New("at least two folds are needed for cross-validation")
+	}
+
+	results := make([]result, 0)
+	for fold := 0; fold < folds; fold++ {
+		train := make([]TrainingTexts, 0)
+		test := make([]TrainingTexts, 0)
+		for _, cls := range classification.Classification {
+			trainTexts := make([]string, 0)
+			testTexts := make([]string, 0)
+			for i, txt := range cls.Texts {
+				if i%folds == fold {
+					testTexts = append(testTexts, txt)
+				} else {
+					trainTexts = append(trainTexts, txt)
+				}
+			}
+			if len(trainTexts) > 0 {
+				train = append(train, TrainingTexts{cls.Command, trainTexts})
+			}
+			test = append(test, TrainingTexts{cls.Command, testTexts})
+		}
+
+		foldResults, err := predictAll(train, test, classification.Pipeline)
+		if err != nil {
+			return Evaluation{}, fmt.Errorf("fold %v: %v", fold, err)
+		}
+		results = append(results, foldResults...)
+	}
+
+	evaluation := newEvaluation(results, classification.Pipeline.Threshold)
+	evaluation.Folds = folds
+	return evaluation, nil
+}
+
+// Evaluate trains a classifier with a classification and evaluates it over
+// a separate set of test texts
+func Evaluate(classification Classification, test []TrainingTexts) (Evaluation, error) {
+	results, err := predictAll(classification.Classification, test, classification.Pipeline)
+	if err != nil {
+		return Evaluation{}, err
+	}
+	return newEvaluation(results, classification.Pipeline.Threshold), nil
+}
+
+// predictAll trains a classifier without threshold and predicts the test texts
+func predictAll(train, test []TrainingTexts, pipeline PipelineConfig) ([]result, error) {
+	if len(train) < 2 {
+		return nil, errors.New("at least two commands are needed for classification")
+	}
+
+	pipeline.Threshold = 0
+	classifier, err := newClassifier(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	if err := classifier.Learn(train); err != nil {
+		return nil, err
+	}
+
+	results := make([]result, 0)
+	for _, cls := range test {
+		for _, txt := range cls.Texts {
+			pred, prob := classifier.Predict(txt)
+			results = append(results, result{cls.Command, pred, prob})
+		}
+	}
+	return results, nil
+}
+
+// newEvaluation computes the scores of a list of results for a threshold
+func newEvaluation(results []result, threshold float64) Evaluation {
+	e := Evaluation{
+		Samples:   len(results),
+		Commands:  make(map[string]Score),
+		Confusion: make(map[string]map[string]int),
+		Threshold: ThresholdEffect{Threshold: threshold},
+	}
+
+	correct, correctWithout := 0, 0
+	predicted := make(map[string]int)
+	truePositives := make(map[string]int)
+	support := make(map[string]int)
+
+	for _, r := range results {
+		pred := r.Predicted
+		if pred == "" {
+			pred = Unsure
+			e.Threshold.UnsureWithout++
+		} else if r.Prob < threshold {
+			pred = Unsure
+			e.Threshold.Rejected++
+			if r.Predicted == r.Actual {
+				e.Threshold.RejectedCorrect++
+			}
+		}
+		if r.Predicted == r.Actual {
+			correctWithout++
+		}
+		if pred == Unsure {
+			e.Threshold.UnsureWith++
+		}
+
+		if e.Confusion[r.Actual] == nil {
+			e.Confusion[r.Actual] = make(map[string]int)
+		}
+		e.Confusion[r.Actual][pred]++
+
+		support[r.Actual]++
+		predicted[pred]++
+		if pred == r.Actual {
+			correct++
+			truePositives[pred]++
+		}
+	}
+
+	commands := make(map[string]bool)
+	for cmd := range support {
+		commands[cmd] = true
+	}
+	for cmd := range predicted {
+		commands[cmd] = cmd != Unsure
+	}
+
+	for cmd, ok := range commands {
+		if !ok {
+			continue
+		}
+		score := Score{Support: support[cmd]}
+		if predicted[cmd] > 0 {
+			score.Precision = float64(truePositives[cmd]) / float64(predicted[cmd])
+		}
+		if support[cmd] > 0 {
+			score.Recall = float64(truePositives[cmd]) / float64(support[cmd])
+		}
+		if score.Precision+score.Recall > 0 {
+			score.F1 = 2 * score.Precision * score.Recall / (score.Precision + score.Recall)
+		}
+		e.Commands[cmd] = score
+	}
+
+	if len(results) > 0 {
+		e.Accuracy = float64(correct) / float64(len(results))
+		e.Threshold.AccuracyWithout = float64(correctWithout) / float64(len(results))
+	}
+
+	return e
+}
+
+// Print writes the Evaluation as tables
+func (e *Evaluation) Print(w io.Writer) {
+	commands := make([]string, 0)
+	for cmd := range e.Commands {
+		commands = append(commands, cmd)
+	}
+	sort.Strings(commands)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	if e.Folds > 0 {
+		fmt.Fprintf(tw, "Folds:\t%v\n", e.Folds)
+	}
+	fmt.Fprintf(tw, "Samples:\t%v\n", e.Samples)
+	fmt.Fprintf(tw, "Accuracy:\t%0.3f\n\n", e.Accuracy)
+
+	fmt.Fprintln(tw, "command\tprecision\trecall\tf1\tsupport")
+	for _, cmd := range commands {
+		s := e.Commands[cmd]
+		fmt.Fprintf(tw, "%v\t%0.3f\t%0.3f\t%0.3f\t%v\n", cmd, s.Precision, s.Recall, s.F1, s.Support)
+	}
+	fmt.Fprintln(tw)
+
+	columns := append(commands, Unsure)
+	fmt.Fprint(tw, "actual \\ predicted")
+	for _, col := range columns {
+		fmt.Fprintf(tw, "\t%v", col)
+	}
+	fmt.Fprintln(tw)
+	for _, cmd := range commands {
+		if e.Commands[cmd].Support == 0 {
+			continue
+		}
+		fmt.Fprint(tw, cmd)
+		for _, col := range columns {
+			fmt.Fprintf(tw, "\t%v", e.Confusion[cmd][col])
+		}
+		fmt.Fprintln(tw)
+	}
+	fmt.Fprintln(tw)
+
+	t := e.Threshold
+	fmt.Fprintf(tw, "Threshold:\t%v\n", t.Threshold)
+	fmt.Fprintf(tw, "Accuracy without threshold:\t%0.3f\n", t.AccuracyWithout)
+	fmt.Fprintf(tw, "Rejected by threshold:\t%v (%v would have been correct)\n", t.Rejected, t.RejectedCorrect)
+	fmt.Fprintf(tw, "Unsure with / without threshold:\t%v / %v\n", t.UnsureWith, t.UnsureWithout)
+
+	tw.Flush()
+}
@@ -7,6 +7,7 @@ import (
 
 // PipelineConfig defines a Pipeline configuration
 type PipelineConfig struct {
+	Classifier    string  `mapstructure:"classifier"`
 	RemoveSymbols bool    `mapstructure:"remove_symbols"`
 	Lower         bool    `mapstructure:"lower"`
 	Threshold     float64 `mapstructure:"threshold"`
@@ -0,0 +1,125 @@
+package clf
+
+import (
+	"math"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// vector is a sparse vector of term weights
+type vector map[string]float64
+
+// TFIDFClassifier models a nearest-neighbour classifier over TF-IDF vectors,
+// a text is classified as the command of its most similar training text
+type TFIDFClassifier struct {
+	IDF      map[string]float64
+	Docs     []vector
+	Labels   []string
+	Pipeline PipelineConfig
+}
+
+// NewTFIDFClassifier returns an untrained TFIDFClassifier
+func NewTFIDFClassifier(pipeline PipelineConfig) *TFIDFClassifier {
+	return &TFIDFClassifier{Pipeline: pipeline}
+}
+
+// Learn trains the classifier with the given texts
+func (c *TFIDFClassifier) Learn(texts []TrainingTexts) error {
+	tokens := make([][]string, 0)
+	labels := make([]string, 0)
+	df := make(map[string]float64)
+
+	for _, cls := range texts {
+		for _, txt := range cls.Texts {
+			toks := c.tokens(txt)
+			seen := make(map[string]bool)
+			for _, tok := range toks {
+				if !seen[tok] {
+					df[tok]++
+					seen[tok] = true
+				}
+			}
+			tokens = append(tokens, toks)
+			labels = append(labels, cls.Command)
+		}
+	}
+
+	n := float64(len(tokens))
+	c.IDF = make(map[string]float64)
+	for tok, freq := range df {
+		c.IDF[tok] = math.Log((1+n)/(1+freq)) + 1 // Smoothed IDF
+	}
+
+	c.Docs = make([]vector, len(tokens))
+	for i, toks := range tokens {
+		c.Docs[i] = c.vectorize(toks)
+	}
+	c.Labels = labels
+
+	return nil
+}
+
+// Classify returns the most similar class for a given text
+func (c *TFIDFClassifier) Classify(text string) (string, float64, bool) {
+	vec := c.vectorize(c.tokens(text))
+
+	class, sim := "", 0.0
+	for i, doc := range c.Docs {
+		if s := cosine(vec, doc); s > sim {
+			class, sim = c.Labels[i], s
+		}
+	}
+
+	log.Debugf("CLF | \"%v\" classified as %v (%0.2f%%)", text, class, sim*100)
+	return class, sim, class != "" && sim >= c.Pipeline.Threshold
+}
+
+// Predict predict a class for a given text
+func (c *TFIDFClassifier) Predict(text string) (string, float64) {
+	return predict(c, text)
+}
+
+// tokens returns the non-empty tokens of a text after the pipeline
+func (c *TFIDFClassifier) tokens(text string) []string {
+	toks := make([]string, 0)
+	for _, tok := range Pipeline(&text, &c.Pipeline) {
+		if tok != "" {
+			toks = append(toks, tok)
+		}
+	}
+	return toks
+}
+
+// vectorize returns the normalized TF-IDF vector of a list of tokens, tokens
+// not seen while learning are ignored
+func (c *TFIDFClassifier) vectorize(toks []string) vector {
+	vec := make(vector)
+	for _, tok := range toks {
+		if idf, ok := c.IDF[tok]; ok {
+			vec[tok] += idf
+		}
+	}
+
+	norm := 0.0
+	for _, w := range vec {
+		norm += w * w
+	}
+	norm = math.Sqrt(norm)
+	for tok := range vec {
+		vec[tok] /= norm
+	}
+
+	return vec
+}
+
+// cosine returns the cosine similarity of two normalized vectors
+func cosine(a, b vector) float64 {
+	if len(b) < len(a) {
+		a, b = b, a
+	}
+	dot := 0.0
+	for tok, w := range a {
+		dot += w * b[tok]
+	}
+	return dot
+}
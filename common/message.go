@@ -1,35 +1,77 @@
 package common
 
-// Message models and incoming/outgoing message
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// Message models and incoming/outgoing message, an incoming message can have
+// an explicit Command that is executed instead of the one predicted for its
+// text. An outgoing message can have buttons, quick replies, cards and files
+// that each channel renders natively or as text.
 type Message struct {
-	Sender string `json:"sender"`
-	Text   string `json:"text"`
-	Image  string `json:"image"`
+	Sender       string   `json:"sender"`
+	Text         string   `json:"text"`
+	Image        string   `json:"image"`
+	Command      string   `json:"command,omitempty"`
+	Buttons      []Button `json:"buttons,omitempty"`
+	QuickReplies []Button `json:"quick_replies,omitempty"`
+	Cards        []Card   `json:"cards,omitempty"`
+	Files        []File   `json:"files,omitempty"`
+}
+
+// Button models a button or quick reply, its payload is the command executed
+// when it is chosen, a button with a URL opens it instead
+type Button struct {
+	Text    string `json:"text"`
+	Payload string `json:"payload,omitempty"`
+	URL     string `json:"url,omitempty"`
+}
+
+// Value returns what choosing the button sends on every channel: its payload,
+// or its text if it has no payload and no URL
+func (b Button) Value() string {
+	if b.Payload != "" || b.URL != "" {
+		return b.Payload
+	}
+	return b.Text
+}
+
+// Card models a card with a title, a subtitle, an image and buttons
+type Card struct {
+	Title    string   `json:"title"`
+	Subtitle string   `json:"subtitle,omitempty"`
+	Image    string   `json:"image,omitempty"`
+	Buttons  []Button `json:"buttons,omitempty"`
+}
+
+// File models a file attached to a message
+type File struct {
+	URL  string `json:"url"`
+	Name string `json:"name,omitempty"`
 }
 
 // MessageFromMap converts a map of interfaces or strings into a Message
 func MessageFromMap(msgMap interface{}) Message {
 	msg := Message{}
-	switch m := msgMap.(type) {
-	case map[interface{}]interface{}:
-		msg.Sender, _ = m["sender"].(string)
-		msg.Text, _ = m["text"].(string)
-		msg.Image, _ = m["image"].(string)
-	case map[string]interface{}:
-		msg.Sender, _ = m["sender"].(string)
-		msg.Text, _ = m["text"].(string)
-		msg.Image, _ = m["image"].(string)
-	case map[string]string:
-		msg.Sender, _ = m["sender"]
-		msg.Text, _ = m["text"]
-		msg.Image, _ = m["image"]
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		TagName:          "json",
+		WeaklyTypedInput: true,
+		Result:           &msg,
+	})
+	if err != nil {
+		return msg
 	}
+	decoder.Decode(msgMap)
 	return msg
 }
 
 // Out creates an outgoing message without empty fields
-func (m *Message) Out() map[string]string {
-	o := make(map[string]string)
+func (m *Message) Out() map[string]interface{} {
+	o := make(map[string]interface{})
 	if m.Sender != "" {
 		o["sender"] = m.Sender
 	}
@@ -39,5 +81,120 @@ func (m *Message) Out() map[string]string {
 	if m.Image != "" {
 		o["image"] = m.Image
 	}
+	if len(m.Buttons) > 0 {
+		o["buttons"] = m.Buttons
+	}
+	if len(m.QuickReplies) > 0 {
+		o["quick_replies"] = m.QuickReplies
+	}
+	if len(m.Cards) > 0 {
+		o["cards"] = m.Cards
+	}
+	if len(m.Files) > 0 {
+		o["files"] = m.Files
+	}
 	return o
 }
+
+// Choices returns the buttons of a message that have a value, in the order
+// they are numbered in its PlainText: buttons, buttons of the cards and quick
+// replies
+func (m *Message) Choices() []Button {
+	choices := make([]Button, 0)
+	add := func(buttons []Button) {
+		for _, button := range buttons {
+			if button.Value() != "" {
+				choices = append(choices, button)
+			}
+		}
+	}
+	add(m.Buttons)
+	for _, card := range m.Cards {
+		add(card.Buttons)
+	}
+	add(m.QuickReplies)
+	return choices
+}
+
+// Choose returns the value of the choice of a message that a text answers,
+// by its number or its text
+func (m *Message) Choose(text string) (string, bool) {
+	return Choose(m.Choices(), text)
+}
+
+// Choose returns the value of one of the choices that a text answers, by its
+// number or its text
+func Choose(choices []Button, text string) (string, bool) {
+	text = strings.TrimSpace(text)
+
+	if n, err := strconv.Atoi(strings.TrimSuffix(text, ".")); err == nil && n > 0 && n <= len(choices) {
+		return choices[n-1].Value(), true
+	}
+	for _, choice := range choices {
+		if strings.EqualFold(text, choice.Text) {
+			return choice.Value(), true
+		}
+	}
+	return "", false
+}
+
+// PlainText returns the text of a message with its buttons, cards and quick
+// replies as text for the channels that can't render them, the choices are
+// numbered so that they can be answered with their number
+func (m *Message) PlainText() string {
+	lines := make([]string, 0)
+	if m.Text != "" {
+		lines = append(lines, m.Text)
+	}
+
+	n := 0
+	add := func(buttons []Button) {
+		for _, button := range buttons {
+			if button.Value() != "" {
+				n++
+				lines = append(lines, fmt.Sprintf("%v. %v", n, button.Text))
+			} else if button.URL != "" {
+				lines = append(lines, fmt.Sprintf("%v: %v", button.Text, button.URL))
+			}
+		}
+	}
+
+	add(m.Buttons)
+	for _, card := range m.Cards {
+		if card.Title != "" {
+			lines = append(lines, card.Title)
+		}
+		if card.Subtitle != "" {
+			lines = append(lines, card.Subtitle)
+		}
+		add(card.Buttons)
+	}
+	add(m.QuickReplies)
+
+	return strings.Join(lines, "\n")
+}
+
+// MessagesFrom converts a response, which can be a Message, a string, a map
+// or a list of them, into a list of Messages
+func MessagesFrom(msgs interface{}) ([]Message, error) {
+	// Create slice of messages
+	msgsArr, ok := msgs.([]interface{})
+	if !ok {
+		msgsArr = []interface{}{msgs}
+	}
+
+	messages := make([]Message, 0, len(msgsArr))
+	for _, msgElem := range msgsArr {
+		switch m := msgElem.(type) {
+		case Message:
+			messages = append(messages, m)
+		case string:
+			messages = append(messages, Message{Text: m})
+		case map[interface{}]interface{}, map[string]interface{}, map[string]string:
+			messages = append(messages, MessageFromMap(m))
+		default:
+			return nil, fmt.Errorf("Message type unsupported: %T", m)
+		}
+	}
+	return messages, nil
+}
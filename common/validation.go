@@ -0,0 +1,43 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Validation models the errors and warnings found while validating a bot
+type Validation struct {
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+// Errorf adds an error to the Validation
+func (v *Validation) Errorf(format string, args ...interface{}) {
+	v.Errors = append(v.Errors, fmt.Sprintf(format, args...))
+}
+
+// Warnf adds a warning to the Validation
+func (v *Validation) Warnf(format string, args ...interface{}) {
+	v.Warnings = append(v.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Add adds the errors and warnings of another Validation, prefixed with the
+// file they were found in
+func (v *Validation) Add(file string, o Validation) {
+	for _, e := range o.Errors {
+		v.Errorf("%v: %v", file, e)
+	}
+	for _, w := range o.Warnings {
+		v.Warnf("%v: %v", file, w)
+	}
+}
+
+// Err returns all the errors in the Validation as a single error, or nil if
+// there are none
+func (v *Validation) Err() error {
+	if len(v.Errors) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(v.Errors, "; "))
+}
@@ -0,0 +1,121 @@
+package ent
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Builtin returns the built-in extractors: number, email, phone, url and date
+func Builtin() Extractors {
+	return Extractors{
+		"number": NumberExtractor,
+		"email":  EmailExtractor,
+		"phone":  PhoneExtractor,
+		"url":    URLExtractor,
+		"date":   &DateExtractor{},
+	}
+}
+
+// RegexExtractor extracts the matches of a regular expression as entities,
+// Normalize converts a match into the entity value and can discard it
+type RegexExtractor struct {
+	Name      string
+	Regex     *regexp.Regexp
+	Normalize func(match string) (string, bool)
+}
+
+// Extract returns the entities found in a text
+func (r *RegexExtractor) Extract(text string) []Entity {
+	entities := make([]Entity, 0)
+	for _, loc := range r.Regex.FindAllStringIndex(text, -1) {
+		match := text[loc[0]:loc[1]]
+		value := match
+		if r.Normalize != nil {
+			var ok bool
+			if value, ok = r.Normalize(match); !ok {
+				continue
+			}
+		}
+		entities = append(entities, Entity{
+			Entity: r.Name,
+			Value:  value,
+			Text:   match,
+			Start:  loc[0],
+			End:    loc[1],
+		})
+	}
+	return entities
+}
+
+var numberWords = map[string]string{
+	"zero": "0", "one": "1", "two": "2", "three": "3", "four": "4",
+	"five": "5", "six": "6", "seven": "7", "eight": "8", "nine": "9",
+	"ten": "10", "eleven": "11", "twelve": "12",
+}
+
+// NumberExtractor extracts integers, decimals and small numbers written in words
+var NumberExtractor = &RegexExtractor{
+	Name:  "number",
+	Regex: regexp.MustCompile(`(?i)[-+]?\b\d+(?:\.\d+)?\b|\b(?:zero|one|two|three|four|five|six|seven|eight|nine|ten|eleven|twelve)\b`),
+	Normalize: func(match string) (string, bool) {
+		if n, ok := numberWords[strings.ToLower(match)]; ok {
+			return n, true
+		}
+		f, err := strconv.ParseFloat(match, 64)
+		if err != nil {
+			return "", false
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), true
+	},
+}
+
+// EmailExtractor extracts email addresses
+var EmailExtractor = &RegexExtractor{
+	Name:  "email",
+	Regex: regexp.MustCompile(`[\w.+-]+@[\w-]+(?:\.[\w-]+)+`),
+	Normalize: func(match string) (string, bool) {
+		return strings.ToLower(match), true
+	},
+}
+
+var isoDate = regexp.MustCompile(`^\d{4}-\d{1,2}-\d{1,2}$`)
+
+// PhoneExtractor extracts phone numbers of 7 to 15 digits, the value only
+// keeps the digits and the leading plus sign
+var PhoneExtractor = &RegexExtractor{
+	Name:  "phone",
+	Regex: regexp.MustCompile(`\+?\(?\d[\d\s().-]{5,}\d`),
+	Normalize: func(match string) (string, bool) {
+		if isoDate.MatchString(match) {
+			return "", false
+		}
+		var b strings.Builder
+		if strings.HasPrefix(match, "+") {
+			b.WriteString("+")
+		}
+		digits := 0
+		for _, r := range match {
+			if r >= '0' && r <= '9' {
+				b.WriteRune(r)
+				digits++
+			}
+		}
+		if digits < 7 || digits > 15 {
+			return "", false
+		}
+		return b.String(), true
+	},
+}
+
+// URLExtractor extracts URLs starting with http, https or www
+var URLExtractor = &RegexExtractor{
+	Name:  "url",
+	Regex: regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]*[^\s<>".,!?;:)]`),
+	Normalize: func(match string) (string, bool) {
+		if strings.HasPrefix(strings.ToLower(match), "www.") {
+			return "http://" + match, true
+		}
+		return match, true
+	},
+}
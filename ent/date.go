@@ -0,0 +1,238 @@
+package ent
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateLayout is the layout of the values of date entities
+const DateLayout = "2006-01-02"
+
+// DateExtractor extracts absolute dates, such as "2021-03-04" or "March 4th",
+// and dates relative to the current day, such as "tomorrow", "next friday" or
+// "in 3 days"
+type DateExtractor struct {
+	// Now returns the current time, time.Now is used if nil
+	Now func() time.Time
+}
+
+type dateRule struct {
+	regex *regexp.Regexp
+	date  func(m []string, today time.Time) (time.Time, bool)
+}
+
+var months = map[string]time.Month{
+	"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April,
+	"may": time.May, "jun": time.June, "jul": time.July, "aug": time.August,
+	"sep": time.September, "oct": time.October, "nov": time.November, "dec": time.December,
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+const (
+	monthPattern   = `(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*\.?`
+	weekdayPattern = `(sunday|monday|tuesday|wednesday|thursday|friday|saturday)`
+	dayPattern     = `(\d{1,2})(?:st|nd|rd|th)?`
+	amountPattern  = `(\d+|a|an|one|two|three|four|five|six|seven|eight|nine|ten)`
+	unitPattern    = `(day|week|month|year)s?`
+)
+
+var dateRules = []dateRule{
+	{
+		regex: regexp.MustCompile(`(?i)\b(\d{4})-(\d{1,2})-(\d{1,2})\b`),
+		date: func(m []string, today time.Time) (time.Time, bool) {
+			y, _ := strconv.Atoi(m[1])
+			mo, _ := strconv.Atoi(m[2])
+			d, _ := strconv.Atoi(m[3])
+			return validDate(y, time.Month(mo), d, today.Location())
+		},
+	},
+	{
+		regex: regexp.MustCompile(`(?i)\b` + dayPattern + `\s+(?:of\s+)?` + monthPattern + `(?:,?\s+(\d{4}))?\b`),
+		date: func(m []string, today time.Time) (time.Time, bool) {
+			d, _ := strconv.Atoi(m[1])
+			return validDate(year(m[3], today), months[m[2]], d, today.Location())
+		},
+	},
+	{
+		regex: regexp.MustCompile(`(?i)\b` + monthPattern + `\s+` + dayPattern + `(?:,?\s+(\d{4}))?\b`),
+		date: func(m []string, today time.Time) (time.Time, bool) {
+			d, _ := strconv.Atoi(m[2])
+			return validDate(year(m[3], today), months[m[1]], d, today.Location())
+		},
+	},
+	{
+		regex: regexp.MustCompile(`(?i)\b(?:the\s+)?day\s+after\s+tomorrow\b`),
+		date: func(m []string, today time.Time) (time.Time, bool) {
+			return today.AddDate(0, 0, 2), true
+		},
+	},
+	{
+		regex: regexp.MustCompile(`(?i)\b(?:the\s+)?day\s+before\s+yesterday\b`),
+		date: func(m []string, today time.Time) (time.Time, bool) {
+			return today.AddDate(0, 0, -2), true
+		},
+	},
+	{
+		regex: regexp.MustCompile(`(?i)\b(today|tonight|tomorrow|yesterday)\b`),
+		date: func(m []string, today time.Time) (time.Time, bool) {
+			switch m[1] {
+			case "tomorrow":
+				return today.AddDate(0, 0, 1), true
+			case "yesterday":
+				return today.AddDate(0, 0, -1), true
+			}
+			return today, true
+		},
+	},
+	{
+		regex: regexp.MustCompile(`(?i)\bin\s+` + amountPattern + `\s+` + unitPattern + `\b`),
+		date: func(m []string, today time.Time) (time.Time, bool) {
+			n, ok := amount(m[1])
+			return addUnits(today, n, m[2]), ok
+		},
+	},
+	{
+		regex: regexp.MustCompile(`(?i)\b` + amountPattern + `\s+` + unitPattern + `\s+ago\b`),
+		date: func(m []string, today time.Time) (time.Time, bool) {
+			n, ok := amount(m[1])
+			return addUnits(today, -n, m[2]), ok
+		},
+	},
+	{
+		regex: regexp.MustCompile(`(?i)\bnext\s+(week|month|year)\b`),
+		date: func(m []string, today time.Time) (time.Time, bool) {
+			return addUnits(today, 1, m[1]), true
+		},
+	},
+	{
+		regex: regexp.MustCompile(`(?i)\b(?:(next|last|this)\s+)?` + weekdayPattern + `\b`),
+		date: func(m []string, today time.Time) (time.Time, bool) {
+			weekday, ok := weekdays[m[2]]
+			if !ok {
+				return today, false
+			}
+			diff := int(weekday - today.Weekday())
+			switch m[1] {
+			case "last":
+				if diff >= 0 {
+					diff -= 7
+				}
+			case "this":
+				// "this friday" on a friday is today
+				if diff < 0 {
+					diff += 7
+				}
+			default:
+				if diff <= 0 {
+					diff += 7
+				}
+			}
+			return today.AddDate(0, 0, diff), true
+		},
+	},
+}
+
+// Extract returns the date entities found in a text
+func (d *DateExtractor) Extract(text string) []Entity {
+	now := time.Now
+	if d.Now != nil {
+		now = d.Now
+	}
+	n := now()
+	today := time.Date(n.Year(), n.Month(), n.Day(), 0, 0, 0, 0, n.Location())
+
+	// The rules match the text as is and only the groups are lowercased, since
+	// lowercasing the whole text can change the offsets of the matches
+	entities := make([]Entity, 0)
+	for _, rule := range dateRules {
+		for _, loc := range rule.regex.FindAllStringSubmatchIndex(text, -1) {
+			if overlaps(entities, loc[0], loc[1]) {
+				continue
+			}
+
+			m := make([]string, len(loc)/2)
+			for i := range m {
+				if loc[2*i] >= 0 {
+					m[i] = strings.ToLower(text[loc[2*i]:loc[2*i+1]])
+				}
+			}
+
+			date, ok := rule.date(m, today)
+			if !ok {
+				continue
+			}
+			entities = append(entities, Entity{
+				Entity: "date",
+				Value:  date.Format(DateLayout),
+				Text:   text[loc[0]:loc[1]],
+				Start:  loc[0],
+				End:    loc[1],
+			})
+		}
+	}
+
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i].Start < entities[j].Start
+	})
+	return entities
+}
+
+// overlaps tells if the span between start and end overlaps any entity
+func overlaps(entities []Entity, start, end int) bool {
+	for _, e := range entities {
+		if start < e.End && e.Start < end {
+			return true
+		}
+	}
+	return false
+}
+
+// validDate returns a date if the day exists in the month
+func validDate(y int, m time.Month, d int, loc *time.Location) (time.Time, bool) {
+	date := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	if m < time.January || m > time.December || date.Day() != d {
+		return date, false
+	}
+	return date, true
+}
+
+// year returns the parsed year, or the current one if it is empty
+func year(s string, today time.Time) int {
+	if y, err := strconv.Atoi(s); err == nil {
+		return y
+	}
+	return today.Year()
+}
+
+// amount converts an amount of units written in digits or words to an int
+func amount(s string) (int, bool) {
+	switch s {
+	case "a", "an":
+		return 1, true
+	}
+	if n, ok := numberWords[s]; ok {
+		s = n
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
+
+// addUnits adds an amount of days, weeks, months or years to a date
+func addUnits(date time.Time, n int, unit string) time.Time {
+	switch unit {
+	case "week":
+		return date.AddDate(0, 0, 7*n)
+	case "month":
+		return date.AddDate(0, n, 0)
+	case "year":
+		return date.AddDate(n, 0, 0)
+	}
+	return date.AddDate(0, 0, n)
+}
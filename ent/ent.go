@@ -0,0 +1,86 @@
+package ent
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Entity models a piece of information extracted from a text
+type Entity struct {
+	Entity string `json:"entity"`
+	Value  string `json:"value"`
+	Text   string `json:"text"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+}
+
+// Extractor interface models an extractor that finds entities in a text
+type Extractor interface {
+	Extract(text string) []Entity
+}
+
+// Extractors maps entity names to their extractors
+type Extractors map[string]Extractor
+
+// Lookup models an entity defined by a list of values and their synonyms
+type Lookup struct {
+	Name   string        `yaml:"name"`
+	Values []LookupValue `yaml:"values"`
+}
+
+// LookupValue models a value of a lookup entity and its synonyms
+type LookupValue struct {
+	Value    string   `yaml:"value"`
+	Synonyms []string `yaml:"synonyms"`
+}
+
+// New returns the built-in extractors together with extractors for the
+// given lookup entities
+func New(lookups []Lookup) (Extractors, error) {
+	extractors := Builtin()
+	for _, lookup := range lookups {
+		if lookup.Name == "" {
+			return nil, fmt.Errorf("lookup entity has no name")
+		}
+		if _, ok := extractors[lookup.Name]; ok {
+			return nil, fmt.Errorf("entity '%v' is declared more than once or is built-in", lookup.Name)
+		}
+		extractor, err := NewLookupExtractor(lookup)
+		if err != nil {
+			return nil, err
+		}
+		extractors[lookup.Name] = extractor
+	}
+	return extractors, nil
+}
+
+// Extract returns the entities found by all the extractors, sorted by their
+// position in the text
+func (e Extractors) Extract(text string) []Entity {
+	entities := make([]Entity, 0)
+	for _, extractor := range e {
+		entities = append(entities, extractor.Extract(text)...)
+	}
+
+	sort.Slice(entities, func(i, j int) bool {
+		if entities[i].Start != entities[j].Start {
+			return entities[i].Start < entities[j].Start
+		}
+		return entities[i].Entity < entities[j].Entity
+	})
+	return entities
+}
+
+// First returns the first entity of a given name found in the text
+func (e Extractors) First(name, text string) (Entity, bool) {
+	extractor, ok := e[name]
+	if !ok {
+		return Entity{}, false
+	}
+
+	entities := extractor.Extract(text)
+	if len(entities) == 0 {
+		return Entity{}, false
+	}
+	return entities[0], true
+}
@@ -0,0 +1,138 @@
+package ent
+
+import (
+	"testing"
+	"time"
+)
+
+func values(entities []Entity, name string) []string {
+	vals := make([]string, 0)
+	for _, e := range entities {
+		if e.Entity == name {
+			vals = append(vals, e.Value)
+		}
+	}
+	return vals
+}
+
+func TestBuiltin(t *testing.T) {
+	extractors := Builtin()
+	text := "Send two tickets to John.Doe@Example.com or call +1 (555) 123-4567, see www.example.com/tickets."
+	entities := extractors.Extract(text)
+
+	if got := values(entities, "email"); len(got) != 1 || got[0] != "john.doe@example.com" {
+		t.Errorf("incorrect, got: %v, want: %v.", got, "[john.doe@example.com]")
+	}
+	if got := values(entities, "phone"); len(got) != 1 || got[0] != "+15551234567" {
+		t.Errorf("incorrect, got: %v, want: %v.", got, "[+15551234567]")
+	}
+	if got := values(entities, "url"); len(got) != 1 || got[0] != "http://www.example.com/tickets" {
+		t.Errorf("incorrect, got: %v, want: %v.", got, "[http://www.example.com/tickets]")
+	}
+	if got := values(entities, "number"); len(got) == 0 || got[0] != "2" {
+		t.Errorf("incorrect, got: %v, want: %v.", got, "[2 ...]")
+	}
+
+	for i := 1; i < len(entities); i++ {
+		if entities[i].Start < entities[i-1].Start {
+			t.Errorf("incorrect, entities are not sorted: %v", entities)
+		}
+	}
+}
+
+func TestDate(t *testing.T) {
+	// Wednesday
+	now := func() time.Time { return time.Date(2021, time.March, 3, 15, 0, 0, 0, time.UTC) }
+	extractor := &DateExtractor{Now: now}
+
+	cases := map[string]string{
+		"tomorrow":                   "2021-03-04",
+		"the day after tomorrow":     "2021-03-05",
+		"yesterday":                  "2021-03-02",
+		"in 2 weeks":                 "2021-03-17",
+		"three days ago":             "2021-02-28",
+		"next friday":                "2021-03-05",
+		"on wednesday":               "2021-03-10",
+		"this wednesday":             "2021-03-03",
+		"this monday":                "2021-03-08",
+		"last monday":                "2021-03-01",
+		"2021-12-25":                 "2021-12-25",
+		"March 4th":                  "2021-03-04",
+		"the 1st of january, 2022":   "2022-01-01",
+		"Dec 31":                     "2021-12-31",
+		"Is 30 february a date?":     "",
+		"there are no dates in here": "",
+		"TOMORROW":                   "2021-03-04",
+		"Next FRIDAY":                "2021-03-05",
+	}
+
+	for text, want := range cases {
+		got := values(extractor.Extract(text), "date")
+		if want == "" {
+			if len(got) != 0 {
+				t.Errorf("incorrect for %q, got: %v, want: %v.", text, got, "[]")
+			}
+		} else if len(got) != 1 || got[0] != want {
+			t.Errorf("incorrect for %q, got: %v, want: %v.", text, got, want)
+		}
+	}
+}
+
+func TestDateNonASCII(t *testing.T) {
+	now := func() time.Time { return time.Date(2021, time.March, 3, 15, 0, 0, 0, time.UTC) }
+	extractor := &DateExtractor{Now: now}
+
+	// Lowercasing changes the length of these texts
+	cases := map[string]string{
+		"Ⱥ tomorrow":       "tomorrow",
+		"İ tomorrow":       "tomorrow",
+		"ȺȺ next Friday İ": "next Friday",
+	}
+	for text, want := range cases {
+		entities := extractor.Extract(text)
+		if len(entities) != 1 {
+			t.Errorf("incorrect for %q, got: %v, want: %v.", text, entities, want)
+			continue
+		}
+		if e := entities[0]; e.Text != want || text[e.Start:e.End] != want {
+			t.Errorf("incorrect for %q, got: %q, want: %q.", text, e.Text, want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	extractors, err := New([]Lookup{
+		{
+			Name: "city",
+			Values: []LookupValue{
+				{Value: "New York", Synonyms: []string{"NYC", "the big apple"}},
+				{Value: "York"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := values(extractors.Extract("From nyc to new york and then York"), "city")
+	want := []string{"New York", "New York", "York"}
+	if len(got) != len(want) {
+		t.Fatalf("incorrect, got: %v, want: %v.", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("incorrect, got: %v, want: %v.", got, want)
+		}
+	}
+
+	if _, ok := extractors.First("city", "Boston"); ok {
+		t.Error("incorrect, want: no entity")
+	}
+
+	if _, err := New([]Lookup{{Name: "email", Values: []LookupValue{{Value: "x"}}}}); err == nil {
+		t.Error("incorrect, want: error for a built-in entity name")
+	}
+	if _, err := New([]Lookup{{Name: "empty"}}); err == nil {
+		t.Error("incorrect, want: error for an entity without values")
+	}
+}
@@ -0,0 +1,75 @@
+package ent
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// LookupExtractor extracts the values of a lookup entity, or any of their
+// synonyms, ignoring case
+type LookupExtractor struct {
+	Name     string
+	Regex    *regexp.Regexp
+	Synonyms map[string]string
+}
+
+// NewLookupExtractor returns a LookupExtractor for a lookup entity
+func NewLookupExtractor(lookup Lookup) (*LookupExtractor, error) {
+	synonyms := make(map[string]string)
+	for _, value := range lookup.Values {
+		for _, s := range append([]string{value.Value}, value.Synonyms...) {
+			key := strings.ToLower(strings.TrimSpace(s))
+			if key == "" {
+				continue
+			}
+			if other, ok := synonyms[key]; ok && other != value.Value {
+				return nil, fmt.Errorf("entity '%v': '%v' is a synonym of both '%v' and '%v'", lookup.Name, s, other, value.Value)
+			}
+			synonyms[key] = value.Value
+		}
+	}
+	if len(synonyms) == 0 {
+		return nil, fmt.Errorf("entity '%v' has no values", lookup.Name)
+	}
+
+	// Longer texts go first so that they are preferred over their prefixes
+	texts := make([]string, 0, len(synonyms))
+	for key := range synonyms {
+		texts = append(texts, regexp.QuoteMeta(key))
+	}
+	sort.Slice(texts, func(i, j int) bool {
+		if len(texts[i]) != len(texts[j]) {
+			return len(texts[i]) > len(texts[j])
+		}
+		return texts[i] < texts[j]
+	})
+
+	regex, err := regexp.Compile(`(?i)(?:^|\b)(?:` + strings.Join(texts, "|") + `)(?:\b|$)`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LookupExtractor{
+		Name:     lookup.Name,
+		Regex:    regex,
+		Synonyms: synonyms,
+	}, nil
+}
+
+// Extract returns the entities found in a text
+func (l *LookupExtractor) Extract(text string) []Entity {
+	entities := make([]Entity, 0)
+	for _, loc := range l.Regex.FindAllStringIndex(text, -1) {
+		match := text[loc[0]:loc[1]]
+		entities = append(entities, Entity{
+			Entity: l.Name,
+			Value:  l.Synonyms[strings.ToLower(match)],
+			Text:   match,
+			Start:  loc[0],
+			End:    loc[1],
+		})
+	}
+	return entities
+}
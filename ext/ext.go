@@ -4,39 +4,50 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/rpc"
+	"time"
 
 	"github.com/jaimeteb/chatto/fsm"
+	"github.com/jaimeteb/chatto/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
 // ExtensionsConfig struct models the extensions object in BotConfig
 type ExtensionsConfig struct {
-	Type string `mapstructure:"type"`
-	Host string `mapstructure:"host"`
-	Port int    `mapstructure:"port"`
-	URL  string `mapstructure:"url"`
+	Type    string `mapstructure:"type"`
+	Host    string `mapstructure:"host"`
+	Port    int    `mapstructure:"port"`
+	URL     string `mapstructure:"url"`
+	Timeout int    `mapstructure:"timeout"`
 }
 
 // ExtensionRPC is an RPC Client for extension functions
 type ExtensionRPC struct {
-	Client *rpc.Client
+	Client  *rpc.Client
+	Timeout time.Duration
 }
 
 // ExtensionREST is a REST API URL for extension functions
 type ExtensionREST struct {
-	URL string
+	URL     string
+	Timeout time.Duration
 }
 
-// Extension interface models an extension that can be either RPC or REST
+// Extension interface models an extension that can be either RPC or REST,
+// if an extension function fails the FSM is left unchanged and the default
+// error message is returned along with the error
 type Extension interface {
 	GetAllFuncs() []string
-	RunExtFunc(sender, extName, text string, dom fsm.Domain, m *fsm.FSM) interface{}
+	RunExtFunc(sender, extName, text string, dom fsm.Domain, m *fsm.FSM) (interface{}, error)
+	Close() error
 }
 
 // RunExtFunc runs an extension function over RPC
-func (e *ExtensionRPC) RunExtFunc(sender, extName, text string, dom fsm.Domain, m *fsm.FSM) interface{} {
+func (e *ExtensionRPC) RunExtFunc(sender, extName, text string, dom fsm.Domain, m *fsm.FSM) (interface{}, error) {
+	defer metrics.ObserveExtension(extName, time.Now())
+
 	req := Request{
 		Sen: sender,
 		FSM: m,
@@ -45,15 +56,23 @@ func (e *ExtensionRPC) RunExtFunc(sender, extName, text string, dom fsm.Domain,
 		Dom: dom.NoFuncs(),
 	}
 
+	var timeout <-chan time.Time
+	if e.Timeout > 0 {
+		timeout = time.After(e.Timeout)
+	}
+
 	res := Response{}
-	err := (*e).Client.Call("ListenerRPC.GetFunc", &req, &res)
-	if err != nil {
-		log.Error(err)
-		return dom.DefaultMessages.Error
+	call := e.Client.Go("ListenerRPC.GetFunc", &req, &res, nil)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return failed(extName, call.Error, dom, m)
+		}
+	case <-timeout:
+		return failed(extName, &Error{ErrTimeout, fmt.Sprintf("no response after %v", e.Timeout)}, dom, m)
 	}
 
-	*m = *res.FSM
-	return res.Res
+	return succeeded(extName, &res, dom, m)
 }
 
 // GetAllFuncs retrieves all functions in extension
@@ -67,7 +86,9 @@ func (e *ExtensionRPC) GetAllFuncs() []string {
 }
 
 // RunExtFunc runs an extension function over REST
-func (e *ExtensionREST) RunExtFunc(sender, extName, text string, dom fsm.Domain, m *fsm.FSM) interface{} {
+func (e *ExtensionREST) RunExtFunc(sender, extName, text string, dom fsm.Domain, m *fsm.FSM) (interface{}, error) {
+	defer metrics.ObserveExtension(extName, time.Now())
+
 	req := Request{
 		Sen: sender,
 		FSM: m,
@@ -78,28 +99,27 @@ func (e *ExtensionREST) RunExtFunc(sender, extName, text string, dom fsm.Domain,
 
 	jsonReq, err := json.Marshal(req)
 	if err != nil {
-		log.Error(err)
-		return dom.DefaultMessages.Error
+		return failed(extName, err, dom, m)
 	}
 
-	// TODO: if fail -> don't change states
-	// send error msg from dom
-
-	resp, err := http.Post(fmt.Sprintf("%v/ext/get_func", e.URL), "application/json", bytes.NewBuffer(jsonReq))
-	if err != nil {
-		log.Error(err)
-		return dom.DefaultMessages.Error
+	client := http.Client{Timeout: e.Timeout}
+	resp, err := client.Post(fmt.Sprintf("%v/ext/get_func", e.URL), "application/json", bytes.NewBuffer(jsonReq))
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return failed(extName, &Error{ErrTimeout, err.Error()}, dom, m)
+	} else if err != nil {
+		return failed(extName, err, dom, m)
 	}
 
 	defer resp.Body.Close()
 	res := Response{}
 	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		log.Error(err)
-		return dom.DefaultMessages.Error
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("extension server responded %v", resp.Status)
+		}
+		return failed(extName, err, dom, m)
 	}
 
-	*m = *res.FSM
-	return res.Res
+	return succeeded(extName, &res, dom, m)
 }
 
 // GetAllFuncs retrieves all functions in extension
@@ -120,6 +140,39 @@ func (e *ExtensionREST) GetAllFuncs() []string {
 	return res
 }
 
+// Close closes the connection to the RPC extension server
+func (e *ExtensionRPC) Close() error {
+	return e.Client.Close()
+}
+
+// Close for ExtensionREST, its requests don't keep a connection
+func (e *ExtensionREST) Close() error {
+	return nil
+}
+
+// succeeded updates the FSM with the one in the Response and returns its
+// message, unless the Response has an error
+func succeeded(extName string, res *Response, dom fsm.Domain, m *fsm.FSM) (interface{}, error) {
+	if res.Err != nil {
+		return failed(extName, res.Err, dom, m)
+	}
+	if res.FSM == nil {
+		return failed(extName, fmt.Errorf("extension function '%v' responded without FSM", extName), dom, m)
+	}
+
+	*m = *res.FSM
+	return res.Res, nil
+}
+
+// failed logs the error of an extension function call and returns the
+// default error message
+func failed(extName string, err error, dom fsm.Domain, m *fsm.FSM) (interface{}, error) {
+	log.Error(err)
+	metrics.ExtensionFailures.WithLabelValues(extName).Inc()
+	metrics.Fallbacks.WithLabelValues(metrics.Error).Inc()
+	return dom.Render(dom.DefaultMessages.Error, m), err
+}
+
 // LoadExtensions loads the extensions configuration and connects to the server
 func LoadExtensions(botCfg ExtensionsConfig) (extension Extension) {
 	extension = nil
@@ -130,14 +183,14 @@ func LoadExtensions(botCfg ExtensionsConfig) (extension Extension) {
 		if err != nil {
 			break
 		}
-		ext := ExtensionRPC{client}
+		ext := ExtensionRPC{client, time.Duration(botCfg.Timeout) * time.Second}
 		log.Info("Loaded extensions (RPC):")
 		for i, fun := range ext.GetAllFuncs() {
 			log.Infof("%v\t%v\n", i, fun)
 		}
 		extension = &ext
 	case "REST":
-		ext := ExtensionREST{botCfg.URL}
+		ext := ExtensionREST{botCfg.URL, time.Duration(botCfg.Timeout) * time.Second}
 		log.Info("Loaded extensions (REST):")
 		for i, fun := range ext.GetAllFuncs() {
 			log.Infof("%v\t%v\n", i, fun)
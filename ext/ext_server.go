@@ -7,6 +7,8 @@ import (
 	"net"
 	"net/http"
 	"net/rpc"
+	"runtime/debug"
+	"time"
 
 	cmn "github.com/jaimeteb/chatto/common"
 	"github.com/jaimeteb/chatto/fsm"
@@ -28,8 +30,42 @@ type Request struct {
 type Response struct {
 	FSM *fsm.FSM    `json:"fsm"`
 	Res interface{} `json:"res"`
+	Err *Error      `json:"err,omitempty"`
 }
 
+// Error codes of the extension server
+const (
+	ErrUnknownFunc = "unknown_function"
+	ErrFuncFailed  = "function_failed"
+	ErrTimeout     = "timeout"
+)
+
+// Error models an error of the extension server: an unknown function, a
+// function that failed or a function that timed out
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Code, e.Message)
+}
+
+// status returns the HTTP status code for an Error
+func (e *Error) status() int {
+	switch e.Code {
+	case ErrUnknownFunc:
+		return http.StatusNotFound
+	case ErrTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// Timeout is the time an extension function can run before the server
+// responds with a timeout error, there is no limit if it is not positive
+var Timeout = 30 * time.Second
+
 // GetAllFuncsResponse struct for GetAllFuncs function
 type GetAllFuncsResponse struct {
 	Res []string
@@ -38,6 +74,54 @@ type GetAllFuncsResponse struct {
 // ExtensionMap maps strings to functions to be used in extensions
 type ExtensionMap map[string]func(*Request) *Response
 
+// run runs the requested extension function, it recovers from panics and
+// responds with an Error if the function is unknown, fails or times out
+func (e ExtensionMap) run(req *Request) *Response {
+	fun, ok := e[req.Req]
+	if !ok {
+		return failure(ErrUnknownFunc, "unknown extension function '%v'", req.Req)
+	}
+
+	done := make(chan *Response, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("Extension function '%v' panicked: %v\n%s", req.Req, r, debug.Stack())
+				done <- failure(ErrFuncFailed, "extension function '%v' failed: %v", req.Req, r)
+			}
+		}()
+
+		res := fun(req)
+		if res == nil {
+			done <- failure(ErrFuncFailed, "extension function '%v' returned no response", req.Req)
+			return
+		}
+		if res.FSM == nil {
+			res.FSM = req.FSM
+		}
+		done <- res
+	}()
+
+	var timeout <-chan time.Time
+	if Timeout > 0 {
+		timeout = time.After(Timeout)
+	}
+
+	select {
+	case res := <-done:
+		return res
+	case <-timeout:
+		return failure(ErrTimeout, "extension function '%v' timed out after %v", req.Req, Timeout)
+	}
+}
+
+// failure returns a Response with an Error
+func failure(code, format string, a ...interface{}) *Response {
+	err := &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+	log.Error(err)
+	return &Response{Err: err}
+}
+
 // ListenerRPC contains the ExtensionMap to be served through RPC
 type ListenerRPC struct {
 	ExtensionMap ExtensionMap
@@ -50,13 +134,14 @@ type ListenerREST struct {
 
 // GetFunc returns a requested extension function
 func (l *ListenerRPC) GetFunc(req *Request, res *Response) error {
-	extRes := l.ExtensionMap[req.Req](req)
+	extRes := l.ExtensionMap.run(req)
 
 	res.FSM = extRes.FSM
 	res.Res = extRes.Res
+	res.Err = extRes.Err
 
 	log.Debugf("Request:\t%v,\t%v", req.FSM, req.Req)
-	log.Debugf("Response:\t%v,\t%v", *res.FSM, res.Res)
+	log.Debugf("Response:\t%v,\t%v,\t%v", res.FSM, res.Res, res.Err)
 	return nil
 }
 
@@ -81,10 +166,10 @@ func (l *ListenerREST) GetFunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res := l.ExtensionMap[req.Req](&req)
+	res := l.ExtensionMap.run(&req)
 
 	log.Debugf("Request:\t%v,\t%v", req.FSM, req.Req)
-	log.Debugf("Response:\t%v,\t%v", *res.FSM, res.Res)
+	log.Debugf("Response:\t%v,\t%v,\t%v", res.FSM, res.Res, res.Err)
 
 	js, err := json.Marshal(res)
 	if err != nil {
@@ -93,6 +178,9 @@ func (l *ListenerREST) GetFunc(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	if res.Err != nil {
+		w.WriteHeader(res.Err.status())
+	}
 	w.Write(js)
 }
 
@@ -119,6 +207,7 @@ func ServeExtensionRPC(extMap ExtensionMap) error {
 
 	host := flag.String("host", "0.0.0.0", "Host to run extension server on")
 	port := flag.Int("port", 8770, "Port to run extension server on")
+	flag.DurationVar(&Timeout, "timeout", Timeout, "Time an extension function can run")
 	flag.Parse()
 
 	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%v:%v", *host, *port))
@@ -144,6 +233,7 @@ func ServeExtensionREST(extMap ExtensionMap) error {
 	cmn.SetLogger()
 
 	port := flag.Int("port", 8770, "Port to run extension server on")
+	flag.DurationVar(&Timeout, "timeout", Timeout, "Time an extension function can run")
 	flag.Parse()
 
 	l := ListenerREST{ExtensionMap: extMap}
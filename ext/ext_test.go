@@ -2,10 +2,13 @@ package ext
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/gorilla/mux"
 	cmn "github.com/jaimeteb/chatto/common"
 	"github.com/jaimeteb/chatto/fsm"
 )
@@ -20,12 +23,12 @@ func TestRESTExt(t *testing.T) {
 		URL:  "http://localhost:8771",
 	})
 
-	resp1 := extensionREST1.RunExtFunc("", "ext_any", "hello", fsm.Domain{}, &fsm.FSM{})
+	resp1, _ := extensionREST1.RunExtFunc("", "ext_any", "hello", fsm.Domain{}, &fsm.FSM{})
 	if resp1.(map[string]interface{})["text"] != "Hello Universe" {
 		t.Errorf("resp is incorrect, got: %v, want: %v.", resp1, "Hello Universe")
 	}
 
-	resp2 := extensionREST2.RunExtFunc("", "ext_any", "hello", fsm.Domain{DefaultMessages: fsm.Defaults{Error: "Error"}}, &fsm.FSM{})
+	resp2, _ := extensionREST2.RunExtFunc("", "ext_any", "hello", fsm.Domain{DefaultMessages: fsm.Defaults{Error: "Error"}}, &fsm.FSM{})
 	if resp2.(string) != "Error" {
 		t.Errorf("resp is incorrect, got: %v, want: %v.", resp2, "Error")
 	}
@@ -64,12 +67,12 @@ func TestRPCExt(t *testing.T) {
 			"pokemon": "pikachu",
 		},
 	}
-	resp1 := extensionRPC1.RunExtFunc("", "ext_search_pokemon", "pikachu", testDom, &testFSM)
+	resp1, _ := extensionRPC1.RunExtFunc("", "ext_search_pokemon", "pikachu", testDom, &testFSM)
 	if resp1.(string) == "Error" {
 		t.Errorf("resp is incorrect, got: %v", resp1)
 	}
 
-	resp2 := extensionRPC1.RunExtFunc("", "ext_any", "hello", fsm.Domain{DefaultMessages: fsm.Defaults{Error: "Error"}}, &fsm.FSM{})
+	resp2, _ := extensionRPC1.RunExtFunc("", "ext_any", "hello", fsm.Domain{DefaultMessages: fsm.Defaults{Error: "Error"}}, &fsm.FSM{})
 	if resp2.(string) != "Error" {
 		t.Errorf("resp is incorrect, got: %v, want: %v.", resp2, "Error")
 	}
@@ -130,3 +133,74 @@ func TestRPCExtServer(t *testing.T) {
 	}
 	listener.GetFunc(&req, new(Response))
 }
+
+func TestExtServerErrors(t *testing.T) {
+	Timeout = 100 * time.Millisecond
+	defer func() { Timeout = 30 * time.Second }()
+
+	myExtMap := ExtensionMap{
+		"ext_panic": func(req *Request) *Response {
+			panic("oops")
+		},
+		"ext_nil": func(req *Request) *Response {
+			return nil
+		},
+		"ext_slow": func(req *Request) *Response {
+			time.Sleep(time.Second)
+			return &Response{FSM: req.FSM, Res: "Too late"}
+		},
+		"ext_next": func(req *Request) *Response {
+			return &Response{FSM: &fsm.FSM{State: 2}, Res: "Next"}
+		},
+	}
+
+	r := mux.NewRouter()
+	listener := ListenerREST{myExtMap}
+	r.HandleFunc("/ext/get_func", listener.GetFunc).Methods("POST")
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	extension := &ExtensionREST{URL: server.URL}
+	dom := fsm.Domain{DefaultMessages: fsm.Defaults{Error: "Error"}}
+
+	tests := []struct {
+		extName string
+		code    string
+		status  int
+	}{
+		{"ext_unknown", ErrUnknownFunc, http.StatusNotFound},
+		{"ext_panic", ErrFuncFailed, http.StatusInternalServerError},
+		{"ext_nil", ErrFuncFailed, http.StatusInternalServerError},
+		{"ext_slow", ErrTimeout, http.StatusGatewayTimeout},
+	}
+	for _, test := range tests {
+		req := Request{Req: test.extName, FSM: &fsm.FSM{State: 1}}
+
+		rpcRes := new(Response)
+		if err := (&ListenerRPC{myExtMap}).GetFunc(&req, rpcRes); err != nil || rpcRes.Err == nil || rpcRes.Err.Code != test.code {
+			t.Errorf("%v: incorrect RPC error, got: %v, want: %v.", test.extName, rpcRes.Err, test.code)
+		}
+
+		jsonReq, _ := json.Marshal(req)
+		httpReq, _ := http.NewRequest("POST", "/ext/get_func", bytes.NewBuffer(jsonReq))
+		w := httptest.NewRecorder()
+		listener.GetFunc(w, httpReq)
+		if w.Code != test.status {
+			t.Errorf("%v: incorrect status, got: %v, want: %v.", test.extName, w.Code, test.status)
+		}
+
+		m := &fsm.FSM{State: 1}
+		resp, err := extension.RunExtFunc("", test.extName, "", dom, m)
+		if extErr, ok := err.(*Error); !ok || extErr.Code != test.code {
+			t.Errorf("%v: incorrect REST error, got: %v, want: %v.", test.extName, err, test.code)
+		}
+		if resp != "Error" || m.State != 1 {
+			t.Errorf("%v: incorrect, got: %v and state %v, want: %v and state %v.", test.extName, resp, m.State, "Error", 1)
+		}
+	}
+
+	m := &fsm.FSM{State: 1}
+	if resp, err := extension.RunExtFunc("", "ext_next", "", dom, m); err != nil || resp != "Next" || m.State != 2 {
+		t.Errorf("incorrect, got: %v, %v and state %v, want: %v and state %v.", resp, err, m.State, "Next", 2)
+	}
+}
@@ -0,0 +1,203 @@
+package fsm
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/jaimeteb/chatto/ent"
+	log "github.com/sirupsen/logrus"
+)
+
+// Form models a form, a state in which the FSM keeps asking for the
+// required slots until all of them are filled, and then transitions into
+// another state sending a message or running an extension
+type Form struct {
+	Name    string      `yaml:"name"`
+	Slots   []FormSlot  `yaml:"slots"`
+	Into    string      `yaml:"into"`
+	Message interface{} `yaml:"message"`
+}
+
+// FormSlot models a required slot of a form, how to extract it, how to
+// validate it and what to ask for it
+type FormSlot struct {
+	Name     string      `yaml:"name"`
+	Mode     string      `yaml:"mode"`
+	Regex    string      `yaml:"regex"`
+	Entity   string      `yaml:"entity"`
+	Validate string      `yaml:"validate"`
+	Prompt   interface{} `yaml:"prompt"`
+	Invalid  interface{} `yaml:"invalid"`
+
+	regex    *regexp.Regexp
+	validate *regexp.Regexp
+}
+
+// Slot returns the Slot used to extract a FormSlot, the whole text is used
+// if no mode is set
+func (s *FormSlot) Slot() Slot {
+	mode := s.Mode
+	if mode == "" {
+		mode = "whole_text"
+	}
+	return Slot{Name: s.Name, Mode: mode, Regex: s.Regex, Entity: s.Entity, regex: s.regex}
+}
+
+// compile compiles the extraction and validation regexes of the slot so that
+// they're not compiled for every message
+func (s *FormSlot) compile() error {
+	slot := s.Slot()
+	if err := slot.compile(); err != nil {
+		return err
+	}
+	s.regex = slot.regex
+
+	if s.Validate != "" {
+		r, err := regexp.Compile(s.Validate)
+		if err != nil {
+			return err
+		}
+		s.validate = r
+	}
+	return nil
+}
+
+// extract returns the values for the slot found in a text if the value of the
+// slot itself is found and valid
+func (s *FormSlot) extract(txt string, extractors ent.Extractors) (map[string]string, bool) {
+	slot := s.Slot()
+	values := slot.Extract(txt, extractors)
+
+	value, ok := values[s.Name]
+	if !ok || strings.TrimSpace(value) == "" {
+		return values, false
+	}
+
+	if s.Validate != "" {
+		r := s.validate
+		if r == nil {
+			var err error
+			if r, err = regexp.Compile(s.Validate); err != nil {
+				return values, false
+			}
+		}
+		if !r.MatchString(value) {
+			return values, false
+		}
+	}
+
+	return values, true
+}
+
+// missing returns the first slot of the form that is not filled
+func (f *Form) missing(m *FSM) (*FormSlot, bool) {
+	for i := range f.Slots {
+		if m.Slots[f.Slots[i].Name] == "" {
+			return &f.Slots[i], true
+		}
+	}
+	return nil, false
+}
+
+// start clears the slots of the form, fills the ones that can be extracted
+// from the text that started it and returns the message of the transition
+// followed by the prompt of the first missing slot, or by the message of the
+// form if it's already complete
+func (f *Form) start(m *FSM, txt string, dom Domain, message interface{}) (interface{}, string) {
+	for _, slot := range f.Slots {
+		delete(m.Slots, slot.Name)
+	}
+	for _, slot := range f.Slots {
+		if slot.Slot().Mode == "whole_text" {
+			continue
+		}
+		if values, ok := slot.extract(txt, dom.Extractors); ok {
+			m.Slots[slot.Name] = values[slot.Name]
+		}
+	}
+
+	log.Debugf("FSM | started form %v with slots %v\n", f.Name, m.Slots)
+
+	if next, ok := f.missing(m); ok {
+		return joinMessages(message, next.Prompt), ""
+	}
+
+	// The form is completed right away, its message is sent after the message
+	// of the transition unless it runs an extension
+	response, runExt := f.complete(m, dom)
+	if runExt != "" {
+		return response, runExt
+	}
+	return joinMessages(message, response), ""
+}
+
+// fill tries to fill the missing slot with the text and returns the next
+// prompt, the completion message, or the prompt again if the slot is not
+// valid. Nothing is handled if the slot is not valid and there is a
+// transition for the command, so that the user can leave the form.
+func (f *Form) fill(m *FSM, cmd, txt string, dom Domain) (response interface{}, runExt string, handled bool) {
+	slot, ok := f.missing(m)
+	if !ok {
+		response, runExt = f.complete(m, dom)
+		return response, runExt, true
+	}
+
+	values, valid := slot.extract(txt, dom.Extractors)
+	if !valid {
+		if cmd != "" && (dom.TransitionTable[CmdStateTuple{cmd, -1}] != nil ||
+			dom.TransitionTable[CmdStateTuple{cmd, m.State}] != nil) {
+			return nil, "", false
+		}
+		log.Debugf("FSM | form %v, invalid value for slot %v\n", f.Name, slot.Name)
+		return joinMessages(slot.Invalid, slot.Prompt), "", true
+	}
+
+	for name, value := range values {
+		m.Slots[name] = value
+	}
+
+	if next, ok := f.missing(m); ok {
+		return joinMessages(next.Prompt), "", true
+	}
+
+	response, runExt = f.complete(m, dom)
+	return response, runExt, true
+}
+
+// complete transitions out of the form and returns its message
+func (f *Form) complete(m *FSM, dom Domain) (response interface{}, runExt string) {
+	m.State = dom.StateTable[f.Into]
+	log.Debugf("FSM | completed form %v with slots %v\n", f.Name, m.Slots)
+
+	if r, ok := f.Message.(string); ok && strings.HasPrefix(r, "ext_") {
+		runExt = r
+	}
+	return f.Message, runExt
+}
+
+// joinMessages joins messages, or lists of messages, into a single list
+// skipping empty ones, a single message is returned as is
+func joinMessages(messages ...interface{}) interface{} {
+	joined := make([]interface{}, 0)
+	for _, message := range messages {
+		switch msg := message.(type) {
+		case nil:
+		case []interface{}:
+			joined = append(joined, msg...)
+		case string:
+			if msg != "" {
+				joined = append(joined, msg)
+			}
+		default:
+			joined = append(joined, msg)
+		}
+	}
+
+	switch len(joined) {
+	case 0:
+		return nil
+	case 1:
+		return joined[0]
+	}
+	return joined
+}
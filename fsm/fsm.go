@@ -3,7 +3,12 @@ package fsm
 import (
 	"regexp"
 	"strings"
+	"text/template"
+	"time"
 
+	cmn "github.com/jaimeteb/chatto/common"
+	"github.com/jaimeteb/chatto/ent"
+	"github.com/jaimeteb/chatto/metrics"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/spf13/viper"
@@ -11,10 +16,13 @@ import (
 
 // Config models the yaml configuration
 type Config struct {
-	States    []string   `yaml:"states"`
-	Commands  []string   `yaml:"commands"`
-	Functions []Function `yaml:"functions"`
-	Defaults  Defaults   `yaml:"defaults"`
+	States    []string     `yaml:"states"`
+	Commands  []string     `yaml:"commands"`
+	Functions []Function   `yaml:"functions"`
+	Defaults  Defaults     `yaml:"defaults"`
+	Entities  []ent.Lookup `yaml:"entities"`
+	Forms     []Form       `yaml:"forms"`
+	Timeouts  []Timeout    `yaml:"timeouts"`
 }
 
 // Function models a function in yaml
@@ -23,6 +31,16 @@ type Function struct {
 	Command    string      `yaml:"command"`
 	Slot       Slot        `yaml:"slot"`
 	Message    interface{} `yaml:"message"`
+	OnError    *OnError    `yaml:"on_error" mapstructure:"on_error"`
+	Handoff    bool        `yaml:"handoff"`
+}
+
+// OnError models what happens when the extension of a transition fails: the
+// state to go into instead of staying in the current one, and the message to
+// send instead of the default error message
+type OnError struct {
+	Into    string      `yaml:"into"`
+	Message interface{} `yaml:"message"`
 }
 
 // Transition models a state transition
@@ -31,18 +49,23 @@ type Transition struct {
 	Into string `yaml:"into"`
 }
 
-// Slot models a slot configuration
+// Slot models a slot configuration, a slot can be filled with the whole text,
+// with a regex match (several slots at once if the regex has named groups) or
+// with an entity
 type Slot struct {
-	Name  string `yaml:"name"`
-	Mode  string `yaml:"mode"`
-	Regex string `yaml:"regex"`
+	Name   string `yaml:"name"`
+	Mode   string `yaml:"mode"`
+	Regex  string `yaml:"regex"`
+	Entity string `yaml:"entity"`
+
+	regex *regexp.Regexp
 }
 
 // Defaults models the domain's default messages
 type Defaults struct {
-	Unknown string `yaml:"unknown" json:"unknown"`
-	Unsure  string `yaml:"unsure" json:"unsure"`
-	Error   string `yaml:"error" json:"error"`
+	Unknown interface{} `yaml:"unknown" json:"unknown"`
+	Unsure  interface{} `yaml:"unsure" json:"unsure"`
+	Error   interface{} `yaml:"error" json:"error"`
 }
 
 // Domain models the final configuration of an FSM
@@ -51,7 +74,16 @@ type Domain struct {
 	CommandList     []string
 	TransitionTable map[CmdStateTuple]TransitionFunc
 	SlotTable       map[CmdStateTuple]Slot
+	ErrorTable      map[CmdStateTuple]OnError
+	HandoffTable    map[CmdStateTuple]bool
+	TimeoutTable    map[int][]Timeout
 	DefaultMessages Defaults
+	Extractors      ent.Extractors
+	FormTable       map[int]*Form
+	Templates       map[string]*template.Template
+	BotName         string
+
+	random *Random
 }
 
 // DomainNoFuncs models the final configuration of an FSM without functions
@@ -71,10 +103,15 @@ type CmdStateTuple struct {
 // TransitionFunc models a transition function
 type TransitionFunc func(m *FSM) interface{}
 
-// FSM models a Finite State Machine
+// FSM models a Finite State Machine, while Handoff is set the conversation
+// is handed off to a human agent and the bot doesn't answer. Choices are the
+// buttons and quick replies offered by the last response, which the user can
+// answer by their number or their text.
 type FSM struct {
-	State int               `json:"state"`
-	Slots map[string]string `json:"slots"`
+	State   int               `json:"state"`
+	Slots   map[string]string `json:"slots"`
+	Handoff bool              `json:"handoff,omitempty"`
+	Choices []cmn.Button      `json:"choices,omitempty"`
 }
 
 // NoFuncs returns a Domain without TransitionFunc items in order
@@ -95,95 +132,284 @@ func NewTransitionFunc(s int, r interface{}) TransitionFunc {
 	}
 }
 
+// Copy returns a copy of the FSM and its slots
+func (m *FSM) Copy() *FSM {
+	slots := make(map[string]string, len(m.Slots))
+	for name, value := range m.Slots {
+		slots[name] = value
+	}
+	var choices []cmn.Button
+	if len(m.Choices) > 0 {
+		choices = append(choices, m.Choices...)
+	}
+	return &FSM{State: m.State, Slots: slots, Handoff: m.Handoff, Choices: choices}
+}
+
+// Equal tells if two FSMs have the same state, slots, handoff and choices, a
+// nil FSM is only equal to another nil FSM
+func (m *FSM) Equal(o *FSM) bool {
+	if m == nil || o == nil {
+		return m == o
+	}
+	if m.State != o.State || m.Handoff != o.Handoff || len(m.Slots) != len(o.Slots) || len(m.Choices) != len(o.Choices) {
+		return false
+	}
+	for name, value := range m.Slots {
+		if v, ok := o.Slots[name]; !ok || v != value {
+			return false
+		}
+	}
+	for i := range m.Choices {
+		if m.Choices[i] != o.Choices[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // ExecuteCmd executes a command in FSM
 func (m *FSM) ExecuteCmd(cmd, txt string, dom Domain) (response interface{}, runExt string) {
 	var trans TransitionFunc
-	var tuple CmdStateTuple
 
 	previousState := m.State
+	if m.Slots == nil {
+		m.Slots = make(map[string]string)
+	}
 
-	tupleFromAny := CmdStateTuple{cmd, -1}
-	tupleNormal := CmdStateTuple{cmd, m.State}
-	tupleCmdAny := CmdStateTuple{"any", m.State}
-
-	if dom.TransitionTable[tupleFromAny] == nil {
-		if dom.TransitionTable[tupleCmdAny] == nil {
-			trans = dom.TransitionTable[tupleNormal] // There is no transition "From Any" with cmd, nor "Cmd Any"
-			tuple = tupleNormal
-		} else {
-			trans = dom.TransitionTable[tupleCmdAny] // There is a transition "Cmd Any"
-			tuple = tupleCmdAny
+	if form, ok := dom.FormTable[m.State]; ok {
+		var handled bool
+		if response, runExt, handled = form.fill(m, cmd, txt, dom); handled {
+			if runExt == "" {
+				response = dom.Render(response, m)
+			}
+			log.Debugf("FSM | transitioned %v -> %v\n", previousState, m.State)
+			return
 		}
-	} else {
-		trans = dom.TransitionTable[tupleFromAny] // There is a transition "From Any" with cmd
-		tuple = tupleFromAny
 	}
 
+	tuple := dom.transition(cmd, m.State)
+	trans = dom.TransitionTable[tuple]
+
 	slot := dom.SlotTable[tuple]
-	if slot.Name != "" {
-		switch slot.Mode {
-		case "whole_text":
-			m.Slots[slot.Name] = txt
-		case "regex":
-			if r, err := regexp.Compile(slot.Regex); err == nil {
-				match := r.FindAllString(txt, 1)
-				if len(match) > 0 {
-					m.Slots[slot.Name] = match[0]
-				}
-			}
-		}
+	for name, value := range slot.Extract(txt, dom.Extractors) {
+		m.Slots[name] = value
 	}
 	// log.Debug(m.Slots)
 
 	if cmd == "" {
 		response = dom.DefaultMessages.Unsure // Threshold not met
+		metrics.Fallbacks.WithLabelValues(metrics.Unsure).Inc()
 	} else if trans == nil {
 		response = dom.DefaultMessages.Unknown // Unknown transition
+		metrics.Fallbacks.WithLabelValues(metrics.Unknown).Inc()
 	} else {
 		response = trans(m)
+		if dom.HandoffTable[tuple] {
+			m.Handoff = true
+		}
 		switch r := response.(type) {
 		case string:
 			if strings.HasPrefix(r, "ext_") {
 				runExt = r
 			}
 		}
+		if form, ok := dom.FormTable[m.State]; ok && runExt == "" {
+			response, runExt = form.start(m, txt, dom, response)
+		}
+	}
+
+	if runExt == "" {
+		response = dom.Render(response, m)
 	}
 
 	log.Debugf("FSM | transitioned %v -> %v\n", previousState, m.State)
 	return
 }
 
+// transition returns the tuple of the transition for a command in a state
+func (d *Domain) transition(cmd string, state int) CmdStateTuple {
+	tupleFromAny := CmdStateTuple{cmd, -1}
+	tupleNormal := CmdStateTuple{cmd, state}
+	tupleCmdAny := CmdStateTuple{"any", state}
+
+	if d.TransitionTable[tupleFromAny] != nil {
+		return tupleFromAny // There is a transition "From Any" with cmd
+	} else if d.TransitionTable[tupleCmdAny] != nil {
+		return tupleCmdAny // There is a transition "Cmd Any"
+	}
+	return tupleNormal // There is no transition "From Any" with cmd, nor "Cmd Any"
+}
+
+// HasCommand tells if a command is in the domain
+func (d *Domain) HasCommand(cmd string) bool {
+	for _, c := range d.CommandList {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// ExecuteError handles the failure of the extension run by the transition for
+// a command from a state, according to the on_error of the transition. The
+// FSM goes into its state, or back into the previous one, and its message is
+// returned, or nil to send the default error message. Nothing is handled if
+// the transition has no on_error.
+func (m *FSM) ExecuteError(cmd string, from int, dom Domain) (response interface{}, handled bool) {
+	onError, ok := dom.ErrorTable[dom.transition(cmd, from)]
+	if !ok {
+		return nil, false
+	}
+
+	m.State = from
+	if onError.Into != "" {
+		m.State = dom.StateTable[onError.Into]
+	}
+	log.Debugf("FSM | extension failed, transitioned %v -> %v\n", from, m.State)
+
+	if onError.Message != nil {
+		response = dom.Render(onError.Message, m)
+	}
+	return response, true
+}
+
+// Extract returns the values for the slot found in a text, keyed by slot name
+func (s *Slot) Extract(txt string, extractors ent.Extractors) map[string]string {
+	values := make(map[string]string)
+
+	switch s.Mode {
+	case "whole_text":
+		if s.Name != "" {
+			values[s.Name] = txt
+		}
+	case "regex":
+		r, err := s.pattern()
+		if err != nil {
+			break
+		}
+		if hasNamedGroups(r) {
+			match := r.FindStringSubmatch(txt)
+			for i, name := range r.SubexpNames() {
+				if name != "" && i < len(match) && match[i] != "" {
+					values[name] = match[i]
+				}
+			}
+		} else if match := r.FindString(txt); match != "" && s.Name != "" {
+			values[s.Name] = match
+		}
+	case "entity":
+		if e, ok := extractors.First(s.Entity, txt); ok && s.Name != "" {
+			values[s.Name] = e.Value
+		}
+	}
+
+	return values
+}
+
+// compile compiles the regex of a regex slot so that it's not compiled for
+// every message
+func (s *Slot) compile() error {
+	if s.Mode != "regex" {
+		return nil
+	}
+	r, err := regexp.Compile(s.Regex)
+	if err != nil {
+		return err
+	}
+	s.regex = r
+	return nil
+}
+
+// pattern returns the compiled regex of the slot, it's compiled on the spot
+// if the slot was not built by NewDomain
+func (s *Slot) pattern() (*regexp.Regexp, error) {
+	if s.regex != nil {
+		return s.regex, nil
+	}
+	return regexp.Compile(s.Regex)
+}
+
+// hasNamedGroups tells if a regex has named capture groups
+func hasNamedGroups(r *regexp.Regexp) bool {
+	for _, name := range r.SubexpNames() {
+		if name != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // Load loads configuration from yaml
 func Load(path *string) Config {
+	botConfig, err := LoadConfig(path)
+	if err != nil {
+		log.Panic(err)
+	}
+	return botConfig
+}
+
+// LoadConfig loads configuration from yaml and returns an error if it fails
+func LoadConfig(path *string) (Config, error) {
 	config := viper.New()
 	config.SetConfigName("fsm")
 	config.AddConfigPath(*path)
 
+	var botConfig Config
 	if err := config.ReadInConfig(); err != nil {
-		log.Panic(err)
+		return botConfig, err
 	}
 
-	var botConfig Config
 	if err := config.Unmarshal(&botConfig); err != nil {
-		log.Panic(err)
+		return botConfig, err
 	}
 
-	return botConfig
+	return botConfig, nil
 }
 
 // Create loads a domain struct from loaded configuration
 func Create(path *string) Domain {
-	config := Load(path)
+	domain, err := NewDomain(Load(path))
+	if err != nil {
+		log.Panic(err)
+	}
+	return domain
+}
+
+// NewDomain builds a domain struct from a configuration
+func NewDomain(config Config) (Domain, error) {
 	var domain Domain
 
+	validation := config.Validate()
+	for _, warning := range validation.Warnings {
+		log.Warn(warning)
+	}
+	if err := validation.Err(); err != nil {
+		return domain, err
+	}
+
 	stateTable := make(map[string]int)
 	for i, state := range config.States {
 		stateTable[state] = i
 	}
 	stateTable["any"] = -1 // Add state "any"
 
+	formTable := make(map[int]*Form)
+	for i := range config.Forms {
+		form := config.Forms[i]
+		form.Slots = append([]FormSlot(nil), form.Slots...)
+		for j := range form.Slots {
+			if err := form.Slots[j].compile(); err != nil {
+				return domain, err
+			}
+		}
+		stateTable[form.Name] = len(config.States) + i // Forms are states too
+		formTable[stateTable[form.Name]] = &form
+	}
+
 	transitionTable := make(map[CmdStateTuple]TransitionFunc)
 	slotTable := make(map[CmdStateTuple]Slot)
+	errorTable := make(map[CmdStateTuple]OnError)
+	handoffTable := make(map[CmdStateTuple]bool)
 	for _, function := range config.Functions {
 		tuple := CmdStateTuple{
 			Cmd:   function.Command,
@@ -193,9 +419,24 @@ func Create(path *string) Domain {
 			stateTable[function.Transition.Into],
 			function.Message,
 		)
-		if function.Slot != (Slot{}) {
-			slotTable[tuple] = function.Slot
+		if slot := function.Slot; slot != (Slot{}) {
+			if err := slot.compile(); err != nil {
+				return domain, err
+			}
+			slotTable[tuple] = slot
 		}
+		if function.OnError != nil {
+			errorTable[tuple] = *function.OnError
+		}
+		if function.Handoff {
+			handoffTable[tuple] = true
+		}
+	}
+
+	timeoutTable := make(map[int][]Timeout)
+	for _, timeout := range config.Timeouts {
+		state := stateTable[timeout.State]
+		timeoutTable[state] = append(timeoutTable[state], timeout)
 	}
 
 	domain.StateTable = stateTable
@@ -203,11 +444,30 @@ func Create(path *string) Domain {
 	domain.TransitionTable = transitionTable
 	domain.DefaultMessages = config.Defaults
 	domain.SlotTable = slotTable
+	domain.ErrorTable = errorTable
+	domain.HandoffTable = handoffTable
+	domain.TimeoutTable = timeoutTable
+	domain.FormTable = formTable
+
+	templates := make(map[string]*template.Template)
+	for _, message := range config.messages() {
+		if err := parseTemplates(message, templates); err != nil {
+			return domain, err
+		}
+	}
+	domain.Templates = templates
+	domain.Seed(time.Now().UnixNano())
+
+	extractors, err := ent.New(config.Entities)
+	if err != nil {
+		return domain, err
+	}
+	domain.Extractors = extractors
 
 	log.Info("Loaded states:")
 	for state, i := range stateTable {
 		log.Infof("%v\t%v\n", i, state)
 	}
 
-	return domain
+	return domain, nil
 }
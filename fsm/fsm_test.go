@@ -1,9 +1,23 @@
 package fsm
 
 import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	cmn "github.com/jaimeteb/chatto/common"
+	"github.com/jaimeteb/chatto/ent"
+	"github.com/patrickmn/go-cache"
 )
 
+var ctx = context.Background()
+
 func TestFSM1(t *testing.T) {
 	path := "../examples/00_test/"
 	domain := Create(&path)
@@ -38,18 +52,19 @@ func TestFSM2(t *testing.T) {
 func TestCacheStore(t *testing.T) {
 	machines := LoadStore(StoreConfig{Type: "CACHE"})
 
-	if resp1 := machines.Exists("foo"); resp1 != false {
+	if resp1, _ := machines.Exists(ctx, "foo"); resp1 != false {
 		t.Errorf("incorrect, got: %v, want: %v.", resp1, "false")
 	}
 
 	machines.Set(
+		ctx,
 		"foo",
 		&FSM{
 			State: 0,
 			Slots: make(map[string]string),
 		},
 	)
-	if resp2 := machines.Get("foo"); resp2.State != 0 {
+	if resp2, _ := machines.Get(ctx, "foo"); resp2.State != 0 {
 		t.Errorf("incorrect, got: %v, want: %v.", resp2, "0")
 	}
 
@@ -59,31 +74,141 @@ func TestCacheStore(t *testing.T) {
 			"abc": "xyz",
 		},
 	}
-	machines.Set("foo", newFsm)
-	if resp3 := machines.Get("foo"); resp3.State != 1 {
+	machines.Set(ctx, "foo", newFsm)
+	if resp3, _ := machines.Get(ctx, "foo"); resp3.State != 1 {
 		t.Errorf("incorrect, got: %v, want: %v.", resp3, "1")
 	}
+
+	if resp4, _ := machines.Count(ctx); resp4 != 1 {
+		t.Errorf("incorrect, got: %v, want: %v.", resp4, 1)
+	}
+
+	testCompareAndSet(t, machines)
+	testTimers(t, machines)
+
+	// The expired FSMs are not counted before they are purged
+	expiring := &CacheStoreFSM{C: cache.New(time.Millisecond, 0)}
+	expiring.Set(ctx, "foo", &FSM{State: 1})
+	time.Sleep(5 * time.Millisecond)
+	if count, _ := expiring.Count(ctx); count != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", count, 0)
+	}
+}
+
+func testCompareAndSet(t *testing.T, machines StoreFSM) {
+	old, _ := machines.Get(ctx, "foo")
+	newFsm := &FSM{State: 2, Slots: map[string]string{"abc": "uvw"}}
+
+	if ok, _ := machines.CompareAndSet(ctx, "foo", newFsm, old); ok {
+		t.Error("incorrect, want: not set when the FSM is not the stored one")
+	}
+	if ok, _ := machines.CompareAndSet(ctx, "foo", nil, newFsm); ok {
+		t.Error("incorrect, want: not set when an FSM is stored")
+	}
+	if ok, _ := machines.CompareAndSet(ctx, "foo", old, newFsm); !ok {
+		t.Error("incorrect, want: set when the FSM is the stored one")
+	}
+	if resp, _ := machines.Get(ctx, "foo"); !resp.Equal(newFsm) {
+		t.Errorf("incorrect, got: %v, want: %v.", resp, newFsm)
+	}
+	if ok, _ := machines.CompareAndSet(ctx, "bar", nil, &FSM{State: 1}); !ok {
+		t.Error("incorrect, want: set when no FSM is stored")
+	}
+
+	handedOff := &FSM{State: 1, Slots: map[string]string{}, Handoff: true}
+	if ok, _ := machines.CompareAndSet(ctx, "bar", &FSM{State: 1}, handedOff); !ok {
+		t.Error("incorrect, want: set when the FSM is the stored one")
+	}
+	if resp, _ := machines.Get(ctx, "bar"); !resp.Equal(handedOff) {
+		t.Errorf("incorrect, got: %v, want: %v.", resp, handedOff)
+	}
+	if ok, _ := machines.CompareAndSet(ctx, "bar", &FSM{State: 1}, &FSM{State: 2}); ok {
+		t.Error("incorrect, want: not set when the stored FSM is handed off")
+	}
+
+	offered := handedOff.Copy()
+	offered.Choices = []cmn.Button{{Text: "Yes", Payload: "yes"}, {Text: "No", Payload: "no"}}
+	if ok, _ := machines.CompareAndSet(ctx, "bar", handedOff, offered); !ok {
+		t.Error("incorrect, want: set when the FSM is the stored one")
+	}
+	if resp, _ := machines.Get(ctx, "bar"); !resp.Equal(offered) {
+		t.Errorf("incorrect, got: %v, want: %v.", resp, offered)
+	}
+	if ok, _ := machines.CompareAndSet(ctx, "bar", handedOff, handedOff); ok {
+		t.Error("incorrect, want: not set when the stored FSM has other choices")
+	}
+
+	machines.Set(ctx, "baz", &FSM{State: 1})
+	if users, _ := machines.List(ctx, "", 2); len(users) != 2 || users[0] != "bar" || users[1] != "baz" {
+		t.Errorf("incorrect, got: %v, want: %v.", users, "[bar baz]")
+	}
+	if users, _ := machines.List(ctx, "baz", 2); len(users) != 1 || users[0] != "foo" {
+		t.Errorf("incorrect, got: %v, want: %v.", users, "[foo]")
+	}
+
+	if err := machines.Delete(ctx, "baz"); err != nil {
+		t.Error(err)
+	}
+	if _, err := machines.Get(ctx, "baz"); err != ErrNotFound {
+		t.Errorf("incorrect, got: %v, want: %v.", err, ErrNotFound)
+	}
+}
+
+func testTimers(t *testing.T, machines StoreFSM) {
+	now := time.Now()
+	machines.Schedule(ctx, "foo", []Timer{
+		{User: "foo", State: 1, Index: 0, Due: now.Add(-time.Second)},
+		{User: "foo", State: 1, Index: 1, Due: now.Add(time.Minute)},
+	})
+	machines.Schedule(ctx, "bar", []Timer{{User: "bar", Channel: "slack", State: 2, Due: now.Add(-time.Minute)}})
+	machines.Schedule(ctx, "bar", []Timer{{User: "bar", Channel: "slack", State: 3, Due: now.Add(-time.Second)}})
+
+	due, err := machines.Due(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 2 {
+		t.Fatalf("incorrect, got: %v, want: %v.", due, "2 timers")
+	}
+	for _, timer := range due {
+		if (timer.User == "foo" && timer.Index != 0) || (timer.User == "bar" && (timer.State != 3 || timer.Channel != "slack")) {
+			t.Errorf("incorrect, got: %v, want: %v.", timer, "the due timers")
+		}
+	}
+
+	if due, _ := machines.Due(ctx, now); len(due) != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", due, "no timers")
+	}
+	if due, _ := machines.Due(ctx, now.Add(2*time.Minute)); len(due) != 1 || due[0].Index != 1 {
+		t.Errorf("incorrect, got: %v, want: %v.", due, "the second timer of foo")
+	}
+
+	machines.Schedule(ctx, "foo", []Timer{{User: "foo", Due: now}})
+	machines.Schedule(ctx, "foo", nil)
+	if due, _ := machines.Due(ctx, now); len(due) != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", due, "no timers")
+	}
 }
 
 func TestRedisStore(t *testing.T) {
 	machines := LoadStore(StoreConfig{
-		Type:     "REDIS",
-		Host:     "localhost",
-		Password: "pass",
+		Type:        "REDIS",
+		RedisConfig: RedisConfig{Host: "localhost", Password: "pass"},
 	})
 
-	if resp1 := machines.Exists("foo"); resp1 != false {
+	if resp1, _ := machines.Exists(ctx, "foo"); resp1 != false {
 		t.Errorf("incorrect, got: %v, want: %v.", resp1, "false")
 	}
 
 	machines.Set(
+		ctx,
 		"foo",
 		&FSM{
 			State: 0,
 			Slots: make(map[string]string),
 		},
 	)
-	if resp2 := machines.Get("foo"); resp2.State != 0 {
+	if resp2, _ := machines.Get(ctx, "foo"); resp2.State != 0 {
 		t.Errorf("incorrect, got: %v, want: %v.", resp2, "0")
 	}
 
@@ -93,17 +218,19 @@ func TestRedisStore(t *testing.T) {
 			"abc": "xyz",
 		},
 	}
-	machines.Set("foo", newFsm)
-	if resp3 := machines.Get("foo"); resp3.State != 1 {
+	machines.Set(ctx, "foo", newFsm)
+	if resp3, _ := machines.Get(ctx, "foo"); resp3.State != 1 {
 		t.Errorf("incorrect, got: %v, want: %v.", resp3, "1")
 	}
+
+	testCompareAndSet(t, machines)
+	testTimers(t, machines)
 }
 
 func TestRedisStoreFail(t *testing.T) {
 	machines := LoadStore(StoreConfig{
-		Type:     "REDIS",
-		Host:     "localhost",
-		Password: "foo",
+		Type:        "REDIS",
+		RedisConfig: RedisConfig{Host: "localhost", Password: "foo"},
 	})
 	switch machines.(type) {
 	case *CacheStoreFSM:
@@ -112,3 +239,604 @@ func TestRedisStoreFail(t *testing.T) {
 		t.Error("incorrect, want: *CacheStoreFSM")
 	}
 }
+
+func TestValidate(t *testing.T) {
+	config := Config{
+		States:   []string{"off", "on", "broken"},
+		Commands: []string{"turn_on", "turn_off", "unused"},
+		Functions: []Function{
+			{
+				Transition: Transition{From: "off", Into: "on"},
+				Command:    "turn_on",
+			},
+			{
+				Transition: Transition{From: "onn", Into: "off"},
+				Command:    "turn_off",
+				Slot:       Slot{Name: "foo", Mode: "regex", Regex: "[0-9"},
+			},
+			{
+				Transition: Transition{From: "on", Into: "off"},
+				Command:    "turn_of",
+			},
+		},
+	}
+
+	validation := config.Validate()
+	if len(validation.Errors) != 3 {
+		t.Errorf("incorrect, got: %v, want: %v.", validation.Errors, 3)
+	}
+	if len(validation.Warnings) != 3 {
+		t.Errorf("incorrect, got: %v, want: %v.", validation.Warnings, 3)
+	}
+
+	if _, err := NewDomain(config); err == nil {
+		t.Error("incorrect, want: error")
+	}
+}
+
+func TestValidatePayloads(t *testing.T) {
+	config := Config{
+		States:   []string{"off", "on"},
+		Commands: []string{"turn_on", "turn_off"},
+		Functions: []Function{
+			{
+				Transition: Transition{From: "off", Into: "on"},
+				Command:    "turn_on",
+				Message: map[interface{}]interface{}{
+					"text": "On, turn it off?",
+					"buttons": []interface{}{
+						map[interface{}]interface{}{"text": "Yes", "payload": "turn_off"},
+						map[interface{}]interface{}{"text": "No", "payload": "keep_on"},
+					},
+				},
+			},
+			{
+				Transition: Transition{From: "on", Into: "off"},
+				Command:    "turn_off",
+				Message:    "Off.",
+			},
+		},
+	}
+
+	validation := config.Validate()
+	if len(validation.Errors) != 1 || !strings.Contains(validation.Errors[0], "keep_on") {
+		t.Errorf("incorrect, got: %v, want: %v.", validation.Errors, "[function 0: unknown command 'keep_on' in button payload]")
+	}
+}
+
+func TestSlotExtract(t *testing.T) {
+	extractors := ent.Builtin()
+
+	named := Slot{Mode: "regex", Regex: `(?P<from>\w+) to (?P<into>\w+)`}
+	values := named.Extract("from Paris to Rome", extractors)
+	if values["from"] != "Paris" || values["into"] != "Rome" {
+		t.Errorf("incorrect, got: %v, want: %v.", values, "map[from:Paris into:Rome]")
+	}
+
+	entity := Slot{Name: "mail", Mode: "entity", Entity: "email"}
+	values = entity.Extract("it's FOO@bar.com", extractors)
+	if values["mail"] != "foo@bar.com" {
+		t.Errorf("incorrect, got: %v, want: %v.", values["mail"], "foo@bar.com")
+	}
+
+	values = entity.Extract("I don't have one", extractors)
+	if len(values) != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", values, "map[]")
+	}
+
+	config := Config{
+		States:   []string{"initial"},
+		Commands: []string{"ask"},
+		Functions: []Function{
+			{
+				Transition: Transition{From: "initial", Into: "initial"},
+				Command:    "ask",
+				Slot:       Slot{Name: "city", Mode: "entity", Entity: "city"},
+			},
+		},
+	}
+	if validation := config.Validate(); len(validation.Errors) != 1 {
+		t.Errorf("incorrect, got: %v, want: %v.", validation.Errors, 1)
+	}
+
+	config.Entities = []ent.Lookup{{Name: "city", Values: []ent.LookupValue{{Value: "Paris"}}}}
+	if validation := config.Validate(); len(validation.Errors) != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", validation.Errors, "[]")
+	}
+}
+
+func TestForm(t *testing.T) {
+	config := Config{
+		States:   []string{"initial"},
+		Commands: []string{"book", "cancel"},
+		Functions: []Function{
+			{
+				Transition: Transition{From: "initial", Into: "booking"},
+				Command:    "book",
+				Message:    "Let's book a table.",
+			},
+			{
+				Transition: Transition{From: "any", Into: "initial"},
+				Command:    "cancel",
+				Message:    "Cancelled.",
+			},
+		},
+		Forms: []Form{
+			{
+				Name: "booking",
+				Slots: []FormSlot{
+					{
+						Name:     "guests",
+						Mode:     "entity",
+						Entity:   "number",
+						Validate: "^[1-9]$",
+						Prompt:   "How many guests?",
+						Invalid:  "Between 1 and 9 guests please.",
+					},
+					{
+						Name:   "email",
+						Mode:   "entity",
+						Entity: "email",
+						Prompt: "What's your email?",
+					},
+				},
+				Into:    "initial",
+				Message: "ext_book",
+			},
+		},
+	}
+	domain, err := NewDomain(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := FSM{State: 0, Slots: map[string]string{"email": "old@mail.com"}}
+
+	resp1, _ := machine.ExecuteCmd("book", "book a table", domain)
+	if msgs, ok := resp1.([]interface{}); !ok || len(msgs) != 2 || msgs[1] != "How many guests?" {
+		t.Errorf("resp is incorrect, got: %v, want: %v.", resp1, "[Let's book a table. How many guests?]")
+	}
+	if _, ok := machine.Slots["email"]; ok {
+		t.Error("incorrect, slot was not cleared when starting the form")
+	}
+
+	resp2, _ := machine.ExecuteCmd("", "twenty", domain)
+	if msgs, ok := resp2.([]interface{}); !ok || len(msgs) != 2 || msgs[0] != "Between 1 and 9 guests please." {
+		t.Errorf("resp is incorrect, got: %v, want: %v.", resp2, "[Between 1 and 9 guests please. How many guests?]")
+	}
+
+	resp3, _ := machine.ExecuteCmd("", "4", domain)
+	if resp3 != "What's your email?" || machine.Slots["guests"] != "4" {
+		t.Errorf("resp is incorrect, got: %v, want: %v.", resp3, "What's your email?")
+	}
+
+	resp4, runExt := machine.ExecuteCmd("", "me@mail.com", domain)
+	if runExt != "ext_book" || resp4 != "ext_book" || machine.State != 0 {
+		t.Errorf("resp is incorrect, got: %v, want: %v.", runExt, "ext_book")
+	}
+
+	resp5, _ := machine.ExecuteCmd("book", "book for 2 people", domain)
+	if resp5.([]interface{})[1] != "What's your email?" || machine.Slots["guests"] != "2" {
+		t.Errorf("resp is incorrect, got: %v, want: %v.", resp5, "[Let's book a table. What's your email?]")
+	}
+
+	resp6, _ := machine.ExecuteCmd("cancel", "cancel", domain)
+	if resp6 != "Cancelled." || machine.State != 0 {
+		t.Errorf("resp is incorrect, got: %v, want: %v.", resp6, "Cancelled.")
+	}
+
+	config.Forms[0].Message = "Booked for {{.Slots.guests}}."
+	domain, err = NewDomain(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp7, _ := machine.ExecuteCmd("book", "book for 3 people, me@mail.com", domain)
+	if msgs, ok := resp7.([]interface{}); !ok || len(msgs) != 2 || msgs[0] != "Let's book a table." || msgs[1] != "Booked for 3." {
+		t.Errorf("resp is incorrect, got: %v, want: %v.", resp7, "[Let's book a table. Booked for 3.]")
+	}
+
+	config.Forms[0].Into = "nowhere"
+	if _, err := NewDomain(config); err == nil {
+		t.Error("incorrect, want: error for unknown state")
+	}
+}
+
+func TestExecuteError(t *testing.T) {
+	config := Config{
+		States:   []string{"initial", "paying", "paid", "failed"},
+		Commands: []string{"pay", "refund"},
+		Functions: []Function{
+			{
+				Transition: Transition{From: "initial", Into: "paid"},
+				Command:    "pay",
+				Message:    "ext_pay",
+				OnError:    &OnError{Into: "failed", Message: "Payment failed in {{.State}}."},
+			},
+			{
+				Transition: Transition{From: "paid", Into: "initial"},
+				Command:    "refund",
+				Message:    "ext_refund",
+				OnError:    &OnError{},
+			},
+			{
+				Transition: Transition{From: "failed", Into: "paid"},
+				Command:    "pay",
+				Message:    "ext_pay",
+			},
+		},
+	}
+	domain, err := NewDomain(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	machine := FSM{State: 0}
+	machine.ExecuteCmd("pay", "pay", domain)
+	resp1, ok := machine.ExecuteError("pay", 0, domain)
+	if !ok || resp1 != "Payment failed in failed." || machine.State != domain.StateTable["failed"] {
+		t.Errorf("resp is incorrect, got: %v and state %v, want: %v and state %v.", resp1, machine.State, "Payment failed in failed.", domain.StateTable["failed"])
+	}
+
+	machine.ExecuteCmd("pay", "pay", domain)
+	if _, ok := machine.ExecuteError("pay", domain.StateTable["failed"], domain); ok {
+		t.Error("incorrect, want: not handled without on_error")
+	}
+
+	machine.ExecuteCmd("refund", "refund", domain)
+	resp3, ok := machine.ExecuteError("refund", domain.StateTable["paid"], domain)
+	if !ok || resp3 != nil || machine.State != domain.StateTable["paid"] {
+		t.Errorf("resp is incorrect, got: %v and state %v, want: %v and state %v.", resp3, machine.State, nil, domain.StateTable["paid"])
+	}
+
+	config.Functions[0].OnError.Into = "nowhere"
+	if _, err := NewDomain(config); err == nil {
+		t.Error("incorrect, want: error for unknown state")
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	config := Config{
+		States:   []string{"initial", "agent"},
+		Commands: []string{"help", "hello"},
+		Functions: []Function{
+			{
+				Transition: Transition{From: "initial", Into: "agent"},
+				Command:    "help",
+				Message:    "An agent will be with you shortly.",
+				Handoff:    true,
+			},
+			{
+				Transition: Transition{From: "initial", Into: "initial"},
+				Command:    "hello",
+				Message:    "Hi!",
+			},
+		},
+	}
+	domain, err := NewDomain(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	machine := FSM{State: 0}
+	if machine.ExecuteCmd("hello", "hello", domain); machine.Handoff {
+		t.Error("incorrect, want: not handed off")
+	}
+	if machine.ExecuteCmd("help", "help", domain); !machine.Handoff || machine.State != domain.StateTable["agent"] {
+		t.Errorf("incorrect, got: %v, want: %v.", machine, FSM{State: domain.StateTable["agent"], Handoff: true})
+	}
+	if machine.Equal(&FSM{State: machine.State, Slots: machine.Slots}) {
+		t.Error("incorrect, want: not equal to an FSM that is not handed off")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	config := Config{
+		States:   []string{"initial", "question"},
+		Commands: []string{"start", "answer"},
+		Functions: []Function{
+			{
+				Transition: Transition{From: "initial", Into: "question"},
+				Command:    "start",
+				Message:    "What's the capital of France?",
+			},
+			{
+				Transition: Transition{From: "question", Into: "initial"},
+				Command:    "answer",
+				Message:    "Correct!",
+			},
+		},
+		Timeouts: []Timeout{
+			{State: "question", After: 60, Message: "Take your time."},
+			{State: "question", After: 300, Into: "initial", Message: "Let's start over, {{.State}}."},
+		},
+	}
+	domain, err := NewDomain(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	machine := &FSM{State: 0}
+	if timers := domain.Timers("foo", "rest", machine, now); len(timers) != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", timers, "no timers")
+	}
+
+	machine.ExecuteCmd("start", "start", domain)
+	timers := domain.Timers("foo", "rest", machine, now)
+	if len(timers) != 2 || !timers[1].Due.Equal(now.Add(5*time.Minute)) || timers[1].Channel != "rest" {
+		t.Fatalf("incorrect, got: %v, want: %v.", timers, "2 timers")
+	}
+
+	if resp, ok := machine.ExecuteTimeout(timers[0], domain); !ok || resp != "Take your time." || machine.State != domain.StateTable["question"] {
+		t.Errorf("incorrect, got: %v and state %v, want: %v and state %v.", resp, machine.State, "Take your time.", domain.StateTable["question"])
+	}
+	if resp, ok := machine.ExecuteTimeout(timers[1], domain); !ok || resp != "Let's start over, initial." || machine.State != 0 {
+		t.Errorf("incorrect, got: %v and state %v, want: %v and state %v.", resp, machine.State, "Let's start over, initial.", 0)
+	}
+	if _, ok := machine.ExecuteTimeout(timers[0], domain); ok {
+		t.Error("incorrect, want: not executed in another state")
+	}
+
+	config.Timeouts[0].After = 0
+	config.Timeouts[1].Into = "nowhere"
+	if validation := config.Validate(); len(validation.Errors) != 2 {
+		t.Errorf("incorrect, got: %v, want: %v.", validation.Errors, "2 errors")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	config := Config{
+		States:   []string{"initial", "greeted"},
+		Commands: []string{"greet"},
+		Functions: []Function{
+			{
+				Transition: Transition{From: "initial", Into: "greeted"},
+				Command:    "greet",
+				Slot:       Slot{Name: "name", Mode: "regex", Regex: `[A-Z]\w+`},
+				Message: []interface{}{
+					"Hello {{.Slots.name}}, I'm {{.Bot}}.",
+					map[string]interface{}{"text": "We are in {{.State}}{{.Slots.missing}}."},
+				},
+			},
+		},
+		Defaults: Defaults{Unknown: "Sorry {{.Slots.name}}, can't do that."},
+	}
+	domain, err := NewDomain(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain.BotName = "botto"
+	machine := FSM{State: 0}
+
+	if slot := domain.SlotTable[CmdStateTuple{Cmd: "greet", State: 0}]; slot.regex == nil {
+		t.Error("incorrect, want: slot regex compiled by NewDomain")
+	}
+
+	resp1, _ := machine.ExecuteCmd("greet", "I'm Jaime", domain)
+	msgs := resp1.([]interface{})
+	if msgs[0] != "Hello Jaime, I'm botto." {
+		t.Errorf("resp is incorrect, got: %v, want: %v.", msgs[0], "Hello Jaime, I'm botto.")
+	}
+	if text := msgs[1].(map[string]interface{})["text"]; text != "We are in greeted." {
+		t.Errorf("resp is incorrect, got: %v, want: %v.", text, "We are in greeted.")
+	}
+
+	resp2, _ := machine.ExecuteCmd("greet", "again", domain)
+	if resp2 != "Sorry Jaime, can't do that." {
+		t.Errorf("resp is incorrect, got: %v, want: %v.", resp2, "Sorry Jaime, can't do that.")
+	}
+
+	config.Defaults.Unsure = "{{.Slots.name"
+	if _, err := NewDomain(config); err == nil {
+		t.Error("incorrect, want: error for invalid template")
+	}
+}
+
+func TestRandom(t *testing.T) {
+	config := Config{
+		States:   []string{"initial"},
+		Commands: []string{"greet"},
+		Functions: []Function{
+			{
+				Transition: Transition{From: "initial", Into: "initial"},
+				Command:    "greet",
+				Message: map[string]interface{}{
+					"random": []interface{}{
+						"Hi!",
+						[]interface{}{"Hello!", "How are you?"},
+					},
+				},
+			},
+		},
+		Defaults: Defaults{
+			Unsure: map[interface{}]interface{}{
+				"random": []interface{}{"What?", "Sorry?"},
+			},
+		},
+	}
+	domain, err := NewDomain(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(seed int64) []interface{} {
+		domain.Seed(seed)
+		machine := FSM{State: 0}
+		resps := make([]interface{}, 0)
+		for i := 0; i < 20; i++ {
+			resp, _ := machine.ExecuteCmd("greet", "hi", domain)
+			resps = append(resps, resp)
+		}
+		return resps
+	}
+
+	resps := run(42)
+	seen := make(map[string]bool)
+	for _, resp := range resps {
+		switch r := resp.(type) {
+		case string:
+			seen[r] = r == "Hi!"
+		case []interface{}:
+			seen["group"] = len(r) == 2 && r[0] == "Hello!"
+		default:
+			t.Errorf("resp is incorrect, got: %v", resp)
+		}
+	}
+	if !seen["Hi!"] || !seen["group"] {
+		t.Errorf("incorrect, got: %v, want: both alternatives", seen)
+	}
+
+	again := run(42)
+	for i := range resps {
+		if _, ok := resps[i].(string); ok && resps[i] != again[i] {
+			t.Errorf("incorrect, same seed gave different responses: %v, %v", resps[i], again[i])
+		}
+	}
+
+	machine := FSM{State: 0}
+	if resp, _ := machine.ExecuteCmd("", "foo", domain); resp != "What?" && resp != "Sorry?" {
+		t.Errorf("resp is incorrect, got: %v, want: %v.", resp, "What? or Sorry?")
+	}
+
+	config.Defaults.Unknown = map[string]interface{}{"random": []interface{}{}}
+	if _, err := NewDomain(config); err == nil {
+		t.Error("incorrect, want: error for empty random list")
+	}
+}
+
+func TestRedisStoreStrict(t *testing.T) {
+	_, err := NewStore(StoreConfig{
+		Type:        "REDIS",
+		RedisConfig: RedisConfig{Host: "localhost", Port: 6380, Password: "foo"},
+		Strict:      true,
+	})
+	if err == nil {
+		t.Error("incorrect, want: error for strict store")
+	}
+}
+
+func TestSQLStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	machines := LoadStore(StoreConfig{
+		Type:   "SQL",
+		Driver: "sqlite3",
+		DSN:    filepath.Join(dir, "chatto.db"),
+		TTL:    60,
+		Strict: true,
+	})
+
+	if resp1, _ := machines.Exists(ctx, "foo"); resp1 != false {
+		t.Errorf("incorrect, got: %v, want: %v.", resp1, "false")
+	}
+
+	machines.Set(ctx, "foo", &FSM{State: 1, Slots: map[string]string{"abc": "xyz", "def": "uvw"}})
+	machines.Set(ctx, "foo", &FSM{State: 2, Slots: map[string]string{"abc": "xyz"}})
+	if resp2, _ := machines.Get(ctx, "foo"); !resp2.Equal(&FSM{State: 2, Slots: map[string]string{"abc": "xyz"}}) {
+		t.Errorf("incorrect, got: %v, want: %v.", resp2, "{2 map[abc:xyz]}")
+	}
+	if resp3, _ := machines.Count(ctx); resp3 != 1 {
+		t.Errorf("incorrect, got: %v, want: %v.", resp3, 1)
+	}
+
+	testCompareAndSet(t, machines)
+	testTimers(t, machines)
+
+	// Expire foo
+	store := machines.(*SQLStoreFSM)
+	if _, err := store.DB.Exec(`UPDATE chatto_fsm SET updated = 0 WHERE sender = 'foo'`); err != nil {
+		t.Fatal(err)
+	}
+	if resp4, _ := machines.Exists(ctx, "foo"); resp4 != false {
+		t.Errorf("incorrect, got: %v, want: %v.", resp4, "false")
+	}
+	if ok, _ := machines.CompareAndSet(ctx, "foo", nil, &FSM{State: 1}); !ok {
+		t.Error("incorrect, want: set when the stored FSM expired")
+	}
+
+	store.DB.Exec(`UPDATE chatto_fsm SET updated = 0 WHERE sender = 'foo'`)
+	if err := store.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	var rows int
+	store.DB.QueryRow(`SELECT COUNT(*) FROM chatto_fsm`).Scan(&rows)
+	if rows != 1 {
+		t.Errorf("incorrect, got: %v, want: %v.", rows, 1)
+	}
+
+	// Migrations are only applied once, even by several replicas at once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db, err := sql.Open("sqlite3", filepath.Join(dir, "replica.db"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer db.Close()
+			if err := migrate(db); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := migrate(store.DB); err != nil {
+		t.Error(err)
+	}
+	var version int
+	store.DB.QueryRow(`SELECT MAX(version) FROM chatto_schema_migrations`).Scan(&version)
+	if version != len(migrations) {
+		t.Errorf("incorrect, got: %v, want: %v.", version, len(migrations))
+	}
+
+	// The prefixes are not patterns
+	other := &SQLStoreFSM{DB: store.DB, TTL: 60, Prefix: "ab:"}
+	prefixed := &SQLStoreFSM{DB: store.DB, TTL: 60, Prefix: "a_:"}
+	other.Set(ctx, "foo", &FSM{State: 1})
+	other.Schedule(ctx, "foo", []Timer{{User: "foo", Channel: "rest", Due: time.Now()}})
+	if count, _ := prefixed.Count(ctx); count != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", count, 0)
+	}
+	if users, _ := prefixed.List(ctx, "", 0); len(users) != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", users, "[]")
+	}
+	if due, _ := prefixed.Due(ctx, time.Now()); len(due) != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", due, "no timers")
+	}
+	if users, _ := other.List(ctx, "", 0); len(users) != 1 || users[0] != "foo" {
+		t.Errorf("incorrect, got: %v, want: %v.", users, "[foo]")
+	}
+
+	// Only the expired FSMs of the prefix of a store are purged
+	prefixed.Set(ctx, "foo", &FSM{State: 1})
+	store.DB.Exec(`UPDATE chatto_fsm SET updated = 0 WHERE sender IN ('ab:foo', 'a_:foo')`)
+	if err := prefixed.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	var senders []string
+	left, err := store.DB.Query(`SELECT sender FROM chatto_fsm WHERE sender IN ('ab:foo', 'a_:foo')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for left.Next() {
+		var sender string
+		left.Scan(&sender)
+		senders = append(senders, sender)
+	}
+	left.Close()
+	if len(senders) != 1 || senders[0] != "ab:foo" {
+		t.Errorf("incorrect, got: %v, want: %v.", senders, "[ab:foo]")
+	}
+
+	if err := machines.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := machines.Count(ctx); err == nil {
+		t.Error("incorrect, want: an error after closing the store")
+	}
+}
@@ -0,0 +1,62 @@
+package fsm
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Random is a source of random numbers safe for concurrent use, it is used
+// to choose between alternative messages
+type Random struct {
+	mutex sync.Mutex
+	rnd   *rand.Rand
+}
+
+// NewRandom returns a Random with the given seed
+func NewRandom(seed int64) *Random {
+	return &Random{rnd: rand.New(rand.NewSource(seed))}
+}
+
+// Intn returns a random int in [0, n), a nil Random uses the global source
+func (r *Random) Intn(n int) int {
+	if r == nil {
+		return rand.Intn(n)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.rnd.Intn(n)
+}
+
+// Seed makes the choice of alternative messages deterministic
+func (d *Domain) Seed(seed int64) {
+	d.random = NewRandom(seed)
+}
+
+// alternatives returns the list of alternative messages of a message in the
+// form {"random": [...]}, a list inside the list is a group of messages
+func alternatives(message interface{}) ([]interface{}, bool) {
+	var alts interface{}
+	switch msg := message.(type) {
+	case map[string]interface{}:
+		if len(msg) != 1 {
+			return nil, false
+		}
+		alts = msg["random"]
+	case map[interface{}]interface{}:
+		if len(msg) != 1 {
+			return nil, false
+		}
+		alts = msg["random"]
+	default:
+		return nil, false
+	}
+
+	if alts == nil {
+		return nil, false
+	}
+	list, ok := alts.([]interface{})
+	if !ok {
+		return []interface{}{}, true
+	}
+	return list, true
+}
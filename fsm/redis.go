@@ -0,0 +1,316 @@
+package fsm
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+	cmn "github.com/jaimeteb/chatto/common"
+)
+
+// RedisStoreFSM struct models an FSM sotred on Redis, the state and slots of
+// every user are kept in the keys "<prefix><user>:state" and
+// "<prefix><user>:slots", "<prefix><user>:handoff" is set while the user
+// is handed off and "<prefix><user>:choices" has the choices offered to it as
+// JSON. The timers of all users are kept in the sorted set
+// "<prefix>timers" scored by their due time, and the ones of every user in
+// the set "<prefix><user>:timers".
+type RedisStoreFSM struct {
+	R      *redis.Client
+	TTL    int
+	Prefix string
+}
+
+// RedisConfig models the connection to a Redis server, it's shared by the
+// Redis store, history and handoff
+type RedisConfig struct {
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	DB       int    `mapstructure:"db"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	TLS      bool   `mapstructure:"tls"`
+}
+
+// NewRedisClient connects to the Redis server in the configuration, on port
+// 6379 if there is none
+func NewRedisClient(rc RedisConfig) (*redis.Client, error) {
+	port := rc.Port
+	if port == 0 {
+		port = 6379
+	}
+
+	options := &redis.Options{
+		Addr:     fmt.Sprintf("%v:%v", rc.Host, port),
+		Username: rc.Username,
+		Password: rc.Password,
+		DB:       rc.DB,
+	}
+	if rc.TLS {
+		options.TLSConfig = &tls.Config{ServerName: rc.Host}
+	}
+
+	RDB := redis.NewClient(options)
+	if _, err := RDB.Ping(context.Background()).Result(); err != nil {
+		RDB.Close()
+		return nil, err
+	}
+	return RDB, nil
+}
+
+// NewRedisStore connects to the Redis server in the configuration and
+// returns a RedisStoreFSM
+func NewRedisStore(sc StoreConfig) (*RedisStoreFSM, error) {
+	RDB, err := NewRedisClient(sc.RedisConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisStoreFSM{R: RDB, TTL: sc.TTL, Prefix: sc.Prefix}, nil
+}
+
+// Close for RedisStoreFSM
+func (s *RedisStoreFSM) Close() error {
+	return s.R.Close()
+}
+
+// keys returns the keys of the state, slots, handoff and choices of a user
+func (s *RedisStoreFSM) keys(user string) (string, string, string, string) {
+	return s.Prefix + user + ":state", s.Prefix + user + ":slots", s.Prefix + user + ":handoff", s.Prefix + user + ":choices"
+}
+
+// write writes the state, slots and choices of a user in a transaction, the
+// slots and choices replace the stored ones
+func (s *RedisStoreFSM) write(ctx context.Context, pipe redis.Pipeliner, user string, m *FSM) error {
+	stateKey, slotsKey, handoffKey, choicesKey := s.keys(user)
+	ttl := time.Duration(s.TTL) * time.Second
+
+	pipe.Set(ctx, stateKey, m.State, ttl)
+	pipe.Del(ctx, slotsKey, handoffKey, choicesKey)
+	if m.Handoff {
+		pipe.Set(ctx, handoffKey, 1, ttl)
+	}
+	if len(m.Choices) > 0 {
+		js, err := json.Marshal(m.Choices)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, choicesKey, js, ttl)
+	}
+	if len(m.Slots) > 0 {
+		kvs := make([]string, 0)
+		for k, v := range m.Slots {
+			kvs = append(kvs, k, v)
+		}
+		pipe.HSet(ctx, slotsKey, kvs)
+		if s.TTL > 0 {
+			pipe.Expire(ctx, slotsKey, ttl)
+		}
+	}
+	return nil
+}
+
+// read reads the state, slots and choices of a user
+func (s *RedisStoreFSM) read(ctx context.Context, c redis.Cmdable, user string) (*FSM, error) {
+	stateKey, slotsKey, handoffKey, choicesKey := s.keys(user)
+
+	state, err := c.Get(ctx, stateKey).Int()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	slots, err := c.HGetAll(ctx, slotsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	handoff, err := c.Exists(ctx, handoffKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var choices []cmn.Button
+	if js, err := c.Get(ctx, choicesKey).Bytes(); err == nil {
+		if err := json.Unmarshal(js, &choices); err != nil {
+			return nil, err
+		}
+	} else if err != redis.Nil {
+		return nil, err
+	}
+	return &FSM{State: state, Slots: slots, Handoff: handoff > 0, Choices: choices}, nil
+}
+
+// Exists for RedisStoreFSM
+func (s *RedisStoreFSM) Exists(ctx context.Context, user string) (bool, error) {
+	stateKey, _, _, _ := s.keys(user)
+	n, err := s.R.Exists(ctx, stateKey).Result()
+	return n > 0, err
+}
+
+// Get method for RedisStoreFSM
+func (s *RedisStoreFSM) Get(ctx context.Context, user string) (*FSM, error) {
+	return s.read(ctx, s.R, user)
+}
+
+// Set method for RedisStoreFSM
+func (s *RedisStoreFSM) Set(ctx context.Context, user string, m *FSM) error {
+	_, err := s.R.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return s.write(ctx, pipe, user, m)
+	})
+	return err
+}
+
+// Delete for RedisStoreFSM
+func (s *RedisStoreFSM) Delete(ctx context.Context, user string) error {
+	if err := s.Schedule(ctx, user, nil); err != nil {
+		return err
+	}
+	stateKey, slotsKey, handoffKey, choicesKey := s.keys(user)
+	return s.R.Del(ctx, stateKey, slotsKey, handoffKey, choicesKey).Err()
+}
+
+// List for RedisStoreFSM, all the keys of the store are scanned and sorted
+func (s *RedisStoreFSM) List(ctx context.Context, after string, limit int) ([]string, error) {
+	users := make([]string, 0)
+	iter := s.R.Scan(ctx, 0, s.Prefix+"*:state", 100).Iterator()
+	for iter.Next(ctx) {
+		user := strings.TrimSuffix(strings.TrimPrefix(iter.Val(), s.Prefix), ":state")
+		users = append(users, user)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return page(users, after, limit), nil
+}
+
+// CompareAndSet for RedisStoreFSM, the keys of the user are watched so that
+// the FSM is not set if another client changes them meanwhile
+func (s *RedisStoreFSM) CompareAndSet(ctx context.Context, user string, old, m *FSM) (bool, error) {
+	stateKey, slotsKey, handoffKey, choicesKey := s.keys(user)
+
+	err := s.R.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := s.read(ctx, tx, user)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if !current.Equal(old) {
+			return redis.TxFailedErr
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return s.write(ctx, pipe, user, m)
+		})
+		return err
+	}, stateKey, slotsKey, handoffKey, choicesKey)
+
+	if err == redis.TxFailedErr {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Count for RedisStoreFSM
+func (s *RedisStoreFSM) Count(ctx context.Context) (int, error) {
+	count := 0
+	iter := s.R.Scan(ctx, 0, s.Prefix+"*:state", 100).Iterator()
+	for iter.Next(ctx) {
+		count++
+	}
+	return count, iter.Err()
+}
+
+// maxScheduleAttempts is the number of times the timers of a user are
+// replaced when they are changed meanwhile
+const maxScheduleAttempts = 3
+
+// Schedule for RedisStoreFSM, the old timers are read and replaced in a
+// transaction that is retried if they change meanwhile
+func (s *RedisStoreFSM) Schedule(ctx context.Context, user string, timers []Timer) error {
+	userKey := s.Prefix + user + ":timers"
+
+	members := make([]*redis.Z, 0, len(timers))
+	for _, timer := range timers {
+		js, err := json.Marshal(timer)
+		if err != nil {
+			return err
+		}
+		members = append(members, &redis.Z{Score: float64(timer.Due.UnixNano() / 1e6), Member: string(js)})
+	}
+
+	replace := func(tx *redis.Tx) error {
+		old, err := tx.SMembers(ctx, userKey).Result()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(old) > 0 {
+				pipe.ZRem(ctx, s.Prefix+"timers", stringsToInterfaces(old)...)
+			}
+			pipe.Del(ctx, userKey)
+			if len(members) > 0 {
+				pipe.ZAdd(ctx, s.Prefix+"timers", members...)
+				for _, member := range members {
+					pipe.SAdd(ctx, userKey, member.Member)
+				}
+			}
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for attempt := 0; attempt < maxScheduleAttempts; attempt++ {
+		if err = s.R.Watch(ctx, replace, userKey); err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return err
+}
+
+// Due for RedisStoreFSM, a timer is claimed by the client that removes it
+// from the sorted set
+func (s *RedisStoreFSM) Due(ctx context.Context, now time.Time) ([]Timer, error) {
+	members, err := s.R.ZRangeByScore(ctx, s.Prefix+"timers", &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.UnixNano()/1e6, 10),
+		Count: maxDue,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	due := make([]Timer, 0, len(members))
+	for _, member := range members {
+		if n, err := s.R.ZRem(ctx, s.Prefix+"timers", member).Result(); err != nil {
+			return due, err
+		} else if n == 0 {
+			continue // Claimed by another replica
+		}
+
+		var timer Timer
+		if err := json.Unmarshal([]byte(member), &timer); err != nil {
+			return due, err
+		}
+		s.R.SRem(ctx, s.Prefix+timer.User+":timers", member)
+		due = append(due, timer)
+	}
+	return due, nil
+}
+
+func stringsToInterfaces(strs []string) []interface{} {
+	values := make([]interface{}, len(strs))
+	for i, str := range strs {
+		values[i] = str
+	}
+	return values
+}
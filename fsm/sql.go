@@ -0,0 +1,433 @@
+package fsm
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+
+	// Drivers for the SQL store
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLStoreFSM struct models an FSM stored in a SQL database, either SQLite or
+// PostgreSQL, in the table chatto_fsm
+type SQLStoreFSM struct {
+	DB     *sql.DB
+	TTL    int
+	Prefix string
+
+	once sync.Once
+	done chan struct{}
+}
+
+// migrations are the statements that create and update the schema of the
+// SQL store, they are applied in order and only once, and their versions are
+// recorded in the table chatto_schema_migrations
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS chatto_fsm (
+		sender  VARCHAR(255) PRIMARY KEY,
+		state   INTEGER NOT NULL,
+		slots   TEXT NOT NULL,
+		updated BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS chatto_fsm_updated ON chatto_fsm (updated)`,
+	`ALTER TABLE chatto_fsm ADD COLUMN handoff BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE TABLE IF NOT EXISTS chatto_timer (
+		sender  VARCHAR(255) NOT NULL,
+		idx     INTEGER NOT NULL,
+		state   INTEGER NOT NULL,
+		channel VARCHAR(255) NOT NULL,
+		due     BIGINT NOT NULL,
+		PRIMARY KEY (sender, idx)
+	)`,
+	`CREATE INDEX IF NOT EXISTS chatto_timer_due ON chatto_timer (due)`,
+	`ALTER TABLE chatto_fsm ADD COLUMN choices TEXT NOT NULL DEFAULT ''`,
+}
+
+// NewSQLStore connects to the database in the configuration, migrates its
+// schema and returns a SQLStoreFSM that purges the expired FSMs
+func NewSQLStore(sc StoreConfig) (*SQLStoreFSM, error) {
+	driver := sc.Driver
+	if driver == "" {
+		driver = "sqlite3"
+	}
+	dsn := sc.DSN
+	if dsn == "" && driver == "sqlite3" {
+		dsn = "chatto.db"
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite3" {
+		db.SetMaxOpenConns(1) // SQLite only allows one writer
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("couldn't migrate the SQL store: %v", err)
+	}
+
+	store := &SQLStoreFSM{DB: db, TTL: sc.TTL, Prefix: sc.Prefix, done: make(chan struct{})}
+	if sc.TTL > 0 && sc.Purge > 0 {
+		go store.purge(time.Duration(sc.Purge) * time.Second)
+	}
+	return store, nil
+}
+
+// purge purges the expired FSMs every interval until the store is closed
+func (s *SQLStoreFSM) purge(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Purge(); err != nil {
+				log.Error("Error purging FSMs:", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Close for SQLStoreFSM, it stops purging and closes the database
+func (s *SQLStoreFSM) Close() error {
+	s.once.Do(func() {
+		if s.done != nil {
+			close(s.done)
+		}
+	})
+	return s.DB.Close()
+}
+
+// migrate applies the migrations the database doesn't have yet
+func migrate(db *sql.DB) error {
+	for {
+		version, err := migrateNext(db)
+		if err != nil {
+			return err
+		} else if version == 0 {
+			return nil
+		}
+		log.Debugf("Migrated SQL store to version %v", version)
+	}
+}
+
+// migrateNext applies the next migration in a transaction and returns its
+// version, or 0 if there is none. The version is recorded before the
+// migration so that when several replicas start at once only one of them
+// applies it, and the rest roll back and try again.
+func migrateNext(db *sql.DB) (int, error) {
+	for attempt := 1; ; attempt++ {
+		version, err := migrateVersion(db)
+		if err == nil || attempt == maxMigrateAttempts {
+			return version, err
+		}
+		log.Debugf("Couldn't migrate SQL store, retrying: %v", err)
+		time.Sleep(time.Duration(attempt) * migrateBackoff)
+	}
+}
+
+// migrateVersion applies the next migration in a transaction
+func migrateVersion(db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS chatto_schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM chatto_schema_migrations`).Scan(&version); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if version >= len(migrations) {
+		return 0, tx.Rollback()
+	}
+
+	if _, err := tx.Exec(`INSERT INTO chatto_schema_migrations (version) VALUES ($1)`, version+1); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if _, err := tx.Exec(migrations[version]); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return version + 1, nil
+}
+
+// A migration is tried maxMigrateAttempts times, waiting longer by
+// migrateBackoff each time, since it fails while another replica applies it
+const (
+	maxMigrateAttempts = 5
+	migrateBackoff     = 200 * time.Millisecond
+)
+
+// prefixLen returns the length of the prefix in characters, the senders with
+// the prefix are matched with substr since LIKE would treat the _ and % in it
+// as wildcards
+func (s *SQLStoreFSM) prefixLen() int {
+	return utf8.RuneCountInString(s.Prefix)
+}
+
+// since returns the time of the oldest FSM that has not expired
+func (s *SQLStoreFSM) since() int64 {
+	if s.TTL <= 0 {
+		return 0
+	}
+	return time.Now().Add(-time.Duration(s.TTL) * time.Second).Unix()
+}
+
+// Exists for SQLStoreFSM
+func (s *SQLStoreFSM) Exists(ctx context.Context, user string) (bool, error) {
+	var one int
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT 1 FROM chatto_fsm WHERE sender = $1 AND updated >= $2`,
+		s.Prefix+user, s.since(),
+	).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Get method for SQLStoreFSM
+func (s *SQLStoreFSM) Get(ctx context.Context, user string) (*FSM, error) {
+	m := &FSM{Slots: make(map[string]string)}
+
+	var slots, choices string
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT state, slots, handoff, choices FROM chatto_fsm WHERE sender = $1 AND updated >= $2`,
+		s.Prefix+user, s.since(),
+	).Scan(&m.State, &slots, &m.Handoff, &choices)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(slots), &m.Slots); err != nil {
+		return nil, err
+	}
+	if choices != "" {
+		if err := json.Unmarshal([]byte(choices), &m.Choices); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Set method for SQLStoreFSM
+func (s *SQLStoreFSM) Set(ctx context.Context, user string, m *FSM) error {
+	slots, choices, err := encode(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.ExecContext(ctx,
+		`INSERT INTO chatto_fsm (sender, state, slots, handoff, choices, updated) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (sender) DO UPDATE SET state = excluded.state, slots = excluded.slots, handoff = excluded.handoff, choices = excluded.choices, updated = excluded.updated`,
+		s.Prefix+user, m.State, slots, m.Handoff, choices, time.Now().Unix(),
+	)
+	return err
+}
+
+// Delete for SQLStoreFSM
+func (s *SQLStoreFSM) Delete(ctx context.Context, user string) error {
+	if err := s.Schedule(ctx, user, nil); err != nil {
+		return err
+	}
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM chatto_fsm WHERE sender = $1`, s.Prefix+user)
+	return err
+}
+
+// List for SQLStoreFSM
+func (s *SQLStoreFSM) List(ctx context.Context, after string, limit int) ([]string, error) {
+	query := `SELECT sender FROM chatto_fsm WHERE substr(sender, 1, $1) = $2 AND sender > $3 AND updated >= $4 ORDER BY sender`
+	args := []interface{}{s.prefixLen(), s.Prefix, s.Prefix + after, s.since()}
+	if limit > 0 {
+		query += ` LIMIT $5`
+		args = append(args, limit)
+	}
+
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]string, 0)
+	for rows.Next() {
+		var sender string
+		if err := rows.Scan(&sender); err != nil {
+			return nil, err
+		}
+		users = append(users, strings.TrimPrefix(sender, s.Prefix))
+	}
+	return users, rows.Err()
+}
+
+// CompareAndSet for SQLStoreFSM, the FSM is only updated if the row still
+// has the old state, slots, handoff and choices, or inserted if there is no
+// row or it expired
+func (s *SQLStoreFSM) CompareAndSet(ctx context.Context, user string, old, m *FSM) (bool, error) {
+	slots, choices, err := encode(m)
+	if err != nil {
+		return false, err
+	}
+
+	var res sql.Result
+	if old == nil {
+		res, err = s.DB.ExecContext(ctx,
+			`INSERT INTO chatto_fsm (sender, state, slots, handoff, choices, updated) VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (sender) DO UPDATE SET state = excluded.state, slots = excluded.slots, handoff = excluded.handoff, choices = excluded.choices, updated = excluded.updated
+			WHERE chatto_fsm.updated < $7`,
+			s.Prefix+user, m.State, slots, m.Handoff, choices, time.Now().Unix(), s.since(),
+		)
+	} else {
+		var oldSlots, oldChoices string
+		if oldSlots, oldChoices, err = encode(old); err != nil {
+			return false, err
+		}
+		res, err = s.DB.ExecContext(ctx,
+			`UPDATE chatto_fsm SET state = $1, slots = $2, handoff = $3, choices = $4, updated = $5
+			WHERE sender = $6 AND state = $7 AND slots = $8 AND handoff = $9 AND choices = $10 AND updated >= $11`,
+			m.State, slots, m.Handoff, choices, time.Now().Unix(), s.Prefix+user, old.State, oldSlots, old.Handoff, oldChoices, s.since(),
+		)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Count for SQLStoreFSM
+func (s *SQLStoreFSM) Count(ctx context.Context) (int, error) {
+	var count int
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM chatto_fsm WHERE substr(sender, 1, $1) = $2 AND updated >= $3`,
+		s.prefixLen(), s.Prefix, s.since(),
+	).Scan(&count)
+	return count, err
+}
+
+// Schedule for SQLStoreFSM
+func (s *SQLStoreFSM) Schedule(ctx context.Context, user string, timers []Timer) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM chatto_timer WHERE sender = $1`, s.Prefix+user); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, timer := range timers {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO chatto_timer (sender, idx, state, channel, due) VALUES ($1, $2, $3, $4, $5)`,
+			s.Prefix+user, timer.Index, timer.State, timer.Channel, timer.Due.UnixNano()/1e6,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Due for SQLStoreFSM, a timer is claimed by the client that deletes it
+func (s *SQLStoreFSM) Due(ctx context.Context, now time.Time) ([]Timer, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT sender, idx, state, channel, due FROM chatto_timer WHERE substr(sender, 1, $1) = $2 AND due <= $3 ORDER BY due LIMIT $4`,
+		s.prefixLen(), s.Prefix, now.UnixNano()/1e6, maxDue,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	timers := make([]Timer, 0)
+	for rows.Next() {
+		var timer Timer
+		var due int64
+		if err := rows.Scan(&timer.User, &timer.Index, &timer.State, &timer.Channel, &due); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		timer.Due = time.Unix(0, due*1e6)
+		timers = append(timers, timer)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	due := make([]Timer, 0, len(timers))
+	for _, timer := range timers {
+		res, err := s.DB.ExecContext(ctx,
+			`DELETE FROM chatto_timer WHERE sender = $1 AND idx = $2 AND due = $3`,
+			timer.User, timer.Index, timer.Due.UnixNano()/1e6,
+		)
+		if err != nil {
+			return due, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return due, err
+		} else if n == 0 {
+			continue // Claimed by another replica
+		}
+		timer.User = strings.TrimPrefix(timer.User, s.Prefix)
+		due = append(due, timer)
+	}
+	return due, nil
+}
+
+// Purge deletes the expired FSMs with the prefix of the store, the FSMs of
+// other prefixes can have other TTLs
+func (s *SQLStoreFSM) Purge() error {
+	if s.TTL <= 0 {
+		return nil
+	}
+	_, err := s.DB.Exec(
+		`DELETE FROM chatto_fsm WHERE substr(sender, 1, $1) = $2 AND updated < $3`,
+		s.prefixLen(), s.Prefix, s.since(),
+	)
+	return err
+}
+
+// encode encodes the slots and choices of an FSM as JSON, the keys of the
+// slots are sorted so that equal slots have the same encoding, and no choices
+// are encoded as an empty string
+func encode(m *FSM) (string, string, error) {
+	slots := m.Slots
+	if slots == nil {
+		slots = make(map[string]string)
+	}
+	js, err := json.Marshal(slots)
+	if err != nil || len(m.Choices) == 0 {
+		return string(js), "", err
+	}
+
+	choices, err := json.Marshal(m.Choices)
+	return string(js), string(choices), err
+}
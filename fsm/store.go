@@ -2,124 +2,207 @@ package fsm
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strconv"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
-
-	redis "github.com/go-redis/redis/v8"
 )
 
-var ctx = context.Background()
-var mutex = &sync.RWMutex{}
-
 // StoreConfig struct models a Store configuration in bot.yml
 type StoreConfig struct {
-	Type     string `mapstructure:"type"`
-	TTL      int    `mapstructure:"ttl"`
-	Purge    int    `mapstructure:"purge"`
-	Host     string `mapstructure:"host"`
-	Password string `mapstructure:"password"`
+	RedisConfig `mapstructure:",squash"`
+
+	Type   string `mapstructure:"type"`
+	TTL    int    `mapstructure:"ttl"`
+	Purge  int    `mapstructure:"purge"`
+	Prefix string `mapstructure:"prefix"`
+	Strict bool   `mapstructure:"strict"`
+	Driver string `mapstructure:"driver"`
+	DSN    string `mapstructure:"dsn"`
 }
 
+// ErrNotFound is returned when there is no FSM for a user
+var ErrNotFound = errors.New("fsm not found")
+
 // StoreFSM interface for FSM Store modes
 type StoreFSM interface {
-	Exists(string) bool
-	Get(string) *FSM
-	Set(string, *FSM)
+	Exists(ctx context.Context, user string) (bool, error)
+	// Get returns the FSM of a user, or ErrNotFound
+	Get(ctx context.Context, user string) (*FSM, error)
+	Set(ctx context.Context, user string, m *FSM) error
+	Delete(ctx context.Context, user string) error
+	// List returns, in order, up to limit users after the given one, all of
+	// them if limit is not positive
+	List(ctx context.Context, after string, limit int) ([]string, error)
+	Count(ctx context.Context) (int, error)
+	// CompareAndSet sets the FSM of a user only if the stored one is equal to
+	// old, or if there is none and old is nil
+	CompareAndSet(ctx context.Context, user string, old, m *FSM) (bool, error)
+	// Schedule replaces the timers of a user
+	Schedule(ctx context.Context, user string, timers []Timer) error
+	// Due removes and returns the timers that are due at a given time, every
+	// timer is returned only once even if several replicas share the store
+	Due(ctx context.Context, now time.Time) ([]Timer, error)
+	// Close stops purging the store and closes its connections
+	Close() error
 }
 
 // CacheStoreFSM struct models an FSM sotred in Cache
 type CacheStoreFSM struct {
 	C *cache.Cache
-}
 
-// RedisStoreFSM struct models an FSM sotred on Redis
-type RedisStoreFSM struct {
-	R   *redis.Client
-	TTL int
+	mutex  sync.Mutex
+	timers map[string][]Timer
 }
 
 // Exists for CacheStoreFSM
-func (s *CacheStoreFSM) Exists(user string) (e bool) {
-	mutex.Lock()
+func (s *CacheStoreFSM) Exists(ctx context.Context, user string) (bool, error) {
+	s.mutex.Lock()
 	_, ok := s.C.Get(user)
-	mutex.Unlock()
-	return ok
+	s.mutex.Unlock()
+	return ok, nil
 }
 
-// Exists for RedisStoreFSM
-func (s *RedisStoreFSM) Exists(user string) (e bool) {
-	_, err := s.R.Get(ctx, user+":state").Result()
-	if err == redis.Nil || err != nil {
-		return false
+// Get method for CacheStoreFSM
+func (s *CacheStoreFSM) Get(ctx context.Context, user string) (*FSM, error) {
+	s.mutex.Lock()
+	v, ok := s.C.Get(user)
+	s.mutex.Unlock()
+	if !ok {
+		return nil, ErrNotFound
 	}
-	return true
+	return v.(*FSM).Copy(), nil
 }
 
-// Get method for CacheStoreFSM
-func (s *CacheStoreFSM) Get(user string) *FSM {
-	mutex.Lock()
-	v, _ := s.C.Get(user)
-	mutex.Unlock()
-	return v.(*FSM)
+// Set method for CacheStoreFSM
+func (s *CacheStoreFSM) Set(ctx context.Context, user string, m *FSM) error {
+	s.mutex.Lock()
+	s.C.Set(user, m.Copy(), 0)
+	s.mutex.Unlock()
+	return nil
 }
 
-// Get method for RedisStoreFSM
-func (s *RedisStoreFSM) Get(user string) *FSM {
-	m := &FSM{}
+// Delete for CacheStoreFSM
+func (s *CacheStoreFSM) Delete(ctx context.Context, user string) error {
+	s.mutex.Lock()
+	s.C.Delete(user)
+	delete(s.timers, user)
+	s.mutex.Unlock()
+	return nil
+}
 
-	state, err := s.R.Get(ctx, user+":state").Result()
-	if err != nil {
-		log.Error(err)
-	}
-	i, err := strconv.Atoi(state)
-	if err != nil {
-		log.Error(err)
+// List for CacheStoreFSM
+func (s *CacheStoreFSM) List(ctx context.Context, after string, limit int) ([]string, error) {
+	s.mutex.Lock()
+	users := make([]string, 0)
+	for user := range s.C.Items() {
+		users = append(users, user)
 	}
-	m.State = i
+	s.mutex.Unlock()
+	return page(users, after, limit), nil
+}
 
-	slots, err := s.R.HGetAll(ctx, user+":slots").Result()
-	if err != nil {
-		log.Error(err)
-	}
-	m.Slots = slots
+// CompareAndSet for CacheStoreFSM
+func (s *CacheStoreFSM) CompareAndSet(ctx context.Context, user string, old, m *FSM) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	return m
+	var current *FSM
+	if v, ok := s.C.Get(user); ok {
+		current = v.(*FSM)
+	}
+	if !current.Equal(old) {
+		return false, nil
+	}
+	s.C.Set(user, m.Copy(), 0)
+	return true, nil
 }
 
-// Set method for CacheStoreFSM
-func (s *CacheStoreFSM) Set(user string, m *FSM) {
-	mutex.Lock()
-	s.C.Set(user, m, 0)
-	mutex.Unlock()
+// Count for CacheStoreFSM, the expired FSMs that were not purged yet are not
+// counted
+func (s *CacheStoreFSM) Count(ctx context.Context) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.C.Items()), nil
 }
 
-// Set method for RedisStoreFSM
-func (s *RedisStoreFSM) Set(user string, m *FSM) {
-	if err := s.R.Set(ctx, user+":state", m.State, time.Duration(s.TTL)*time.Second).Err(); err != nil {
-		log.Error("Error setting state:", err)
+// Schedule for CacheStoreFSM
+func (s *CacheStoreFSM) Schedule(ctx context.Context, user string, timers []Timer) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(timers) == 0 {
+		delete(s.timers, user)
+		return nil
 	}
-	if len(m.Slots) > 0 {
-		kvs := make([]string, 0)
-		for k, v := range m.Slots {
-			kvs = append(kvs, k, v)
-		}
+	if s.timers == nil {
+		s.timers = make(map[string][]Timer)
+	}
+	s.timers[user] = append([]Timer{}, timers...)
+	return nil
+}
+
+// Due for CacheStoreFSM
+func (s *CacheStoreFSM) Due(ctx context.Context, now time.Time) ([]Timer, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-		if err := s.R.HSet(ctx, user+":slots", kvs).Err(); err != nil {
-			log.Error("Error setting slots:", err)
+	due := make([]Timer, 0)
+	for user, timers := range s.timers {
+		pending := make([]Timer, 0, len(timers))
+		for _, timer := range timers {
+			if !timer.Due.After(now) && len(due) < maxDue {
+				due = append(due, timer)
+			} else {
+				pending = append(pending, timer)
+			}
 		}
-		if err := s.R.Expire(ctx, user+":slots", time.Duration(s.TTL)*time.Second).Err(); err != nil {
-			log.Error("Error expiring slots:", err)
+		if len(pending) == 0 {
+			delete(s.timers, user)
+		} else {
+			s.timers[user] = pending
 		}
 	}
+	return due, nil
+}
+
+// Close for CacheStoreFSM, the cache is purged until it's garbage collected
+func (s *CacheStoreFSM) Close() error {
+	return nil
+}
+
+// page sorts a list of users and returns up to limit users after the given
+// one, all of them if limit is not positive
+func page(users []string, after string, limit int) []string {
+	sort.Strings(users)
+	i := sort.Search(len(users), func(i int) bool {
+		return users[i] > after
+	})
+	users = users[i:]
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+	}
+	return users
 }
 
-// LoadStore loads a Store according to the configuration
+// LoadStore loads a Store according to the configuration, it panics if a
+// strict store can't be used
 func LoadStore(sc StoreConfig) StoreFSM {
+	machines, err := NewStore(sc)
+	if err != nil {
+		log.Panic(err)
+	}
+	return machines
+}
+
+// NewStore returns a Store according to the configuration. If the Redis or
+// SQL store can't connect a CacheStoreFSM is used instead, unless the store
+// is strict and an error is returned.
+func NewStore(sc StoreConfig) (StoreFSM, error) {
 	var machines StoreFSM
 
 	if sc.TTL == 0 {
@@ -131,36 +214,52 @@ func LoadStore(sc StoreConfig) StoreFSM {
 
 	switch sc.Type {
 	case "REDIS":
-		RDB := redis.NewClient(&redis.Options{
-			Addr:     fmt.Sprintf("%v:6379", sc.Host),
-			Password: sc.Password,
-			DB:       0,
-		})
-		if _, err := RDB.Ping(context.Background()).Result(); err != nil {
-			machines = &CacheStoreFSM{
-				C: cache.New(
-					time.Duration(sc.TTL)*time.Second,
-					time.Duration(sc.Purge)*time.Second,
-				),
-			}
-			log.Warn("Couldn't connect to Redis, using CacheStoreFSM instead")
+		redisStore, err := NewRedisStore(sc)
+		if err != nil && sc.Strict {
+			return nil, fmt.Errorf("couldn't connect to Redis: %v", err)
+		} else if err != nil {
+			machines = NewCacheStore(sc)
+			log.Warnf("Couldn't connect to Redis, using CacheStoreFSM instead: %v", err)
 			log.Infof("* TTL:    %v\n", sc.TTL)
 			log.Infof("* Purge:  %v\n", sc.Purge)
 		} else {
-			machines = &RedisStoreFSM{R: RDB, TTL: sc.TTL}
+			machines = redisStore
 			log.Info("Registered RedisStoreFSM")
+			log.Infof("* Addr:   %v\n", redisStore.R.Options().Addr)
+			log.Infof("* DB:     %v\n", sc.DB)
 			log.Infof("* TTL:    %v\n", sc.TTL)
 		}
-	default:
-		machines = &CacheStoreFSM{
-			C: cache.New(
-				time.Duration(sc.TTL)*time.Second,
-				time.Duration(sc.Purge)*time.Second,
-			),
+	case "SQL":
+		sqlStore, err := NewSQLStore(sc)
+		if err != nil && sc.Strict {
+			return nil, fmt.Errorf("couldn't connect to the database: %v", err)
+		} else if err != nil {
+			machines = NewCacheStore(sc)
+			log.Warnf("Couldn't connect to the database, using CacheStoreFSM instead: %v", err)
+			log.Infof("* TTL:    %v\n", sc.TTL)
+			log.Infof("* Purge:  %v\n", sc.Purge)
+		} else {
+			machines = sqlStore
+			log.Info("Registered SQLStoreFSM")
+			log.Infof("* TTL:    %v\n", sc.TTL)
+			log.Infof("* Purge:  %v\n", sc.Purge)
 		}
+	default:
+		machines = NewCacheStore(sc)
 		log.Info("Registered CacheStoreFSM")
 		log.Infof("* TTL:    %v\n", sc.TTL)
 		log.Infof("* Purge:  %v\n", sc.Purge)
 	}
-	return machines
+	return machines, nil
+}
+
+// NewCacheStore returns a CacheStoreFSM that expires and purges the FSMs
+// according to the configuration
+func NewCacheStore(sc StoreConfig) *CacheStoreFSM {
+	return &CacheStoreFSM{
+		C: cache.New(
+			time.Duration(sc.TTL)*time.Second,
+			time.Duration(sc.Purge)*time.Second,
+		),
+	}
 }
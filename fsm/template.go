@@ -0,0 +1,163 @@
+package fsm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TemplateData models the data available to the templates in messages, for
+// example "Hello {{.Slots.name}}, I'm {{.Bot}}"
+type TemplateData struct {
+	Bot   string
+	State string
+	Slots map[string]string
+}
+
+// messages returns all the messages in a configuration keyed by where they
+// are declared
+func (c *Config) messages() map[string]interface{} {
+	messages := map[string]interface{}{
+		"defaults unknown": c.Defaults.Unknown,
+		"defaults unsure":  c.Defaults.Unsure,
+		"defaults error":   c.Defaults.Error,
+	}
+	for i, function := range c.Functions {
+		messages[fmt.Sprintf("function %v", i)] = function.Message
+		if function.OnError != nil {
+			messages[fmt.Sprintf("function %v on_error", i)] = function.OnError.Message
+		}
+	}
+	for i, timeout := range c.Timeouts {
+		messages[fmt.Sprintf("timeout %v", i)] = timeout.Message
+	}
+	for _, form := range c.Forms {
+		messages[fmt.Sprintf("form '%v'", form.Name)] = form.Message
+		for _, slot := range form.Slots {
+			messages[fmt.Sprintf("form '%v', slot '%v' prompt", form.Name, slot.Name)] = slot.Prompt
+			messages[fmt.Sprintf("form '%v', slot '%v' invalid", form.Name, slot.Name)] = slot.Invalid
+		}
+	}
+	return messages
+}
+
+// isTemplate tells if a text has to be rendered as a template
+func isTemplate(text string) bool {
+	return strings.Contains(text, "{{")
+}
+
+// parseTemplates parses the texts in a message that are templates and adds
+// them to the templates map
+func parseTemplates(message interface{}, templates map[string]*template.Template) error {
+	switch msg := message.(type) {
+	case string:
+		if !isTemplate(msg) || templates[msg] != nil {
+			return nil
+		}
+		tmpl, err := template.New("").Option("missingkey=zero").Parse(msg)
+		if err != nil {
+			return fmt.Errorf("invalid template %q: %v", msg, err)
+		}
+		templates[msg] = tmpl
+	case []interface{}:
+		for _, m := range msg {
+			if err := parseTemplates(m, templates); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}, map[interface{}]interface{}:
+		if alts, ok := alternatives(msg); ok {
+			if len(alts) == 0 {
+				return fmt.Errorf("random must be a non-empty list of messages")
+			}
+			return parseTemplates(alts, templates)
+		}
+	}
+
+	switch msg := message.(type) {
+	case map[string]interface{}:
+		for _, m := range msg {
+			if err := parseTemplates(m, templates); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for _, m := range msg {
+			if err := parseTemplates(m, templates); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Render renders the templates in a message with the data of an FSM, texts
+// that fail to render are kept as they are
+func (d *Domain) Render(message interface{}, m *FSM) interface{} {
+	data := TemplateData{
+		Bot:   d.BotName,
+		State: d.StateName(m.State),
+		Slots: m.Slots,
+	}
+	return d.render(message, &data)
+}
+
+func (d *Domain) render(message interface{}, data *TemplateData) interface{} {
+	switch msg := message.(type) {
+	case string:
+		tmpl, ok := d.Templates[msg]
+		if !ok {
+			return msg
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			log.Error(err)
+			return msg
+		}
+		return buf.String()
+	case []interface{}:
+		rendered := make([]interface{}, 0, len(msg))
+		for _, m := range msg {
+			switch r := d.render(m, data).(type) {
+			case []interface{}:
+				rendered = append(rendered, r...) // A random group inside a list
+			default:
+				rendered = append(rendered, r)
+			}
+		}
+		return rendered
+	case map[string]interface{}, map[interface{}]interface{}:
+		if alts, ok := alternatives(msg); ok && len(alts) > 0 {
+			return d.render(alts[d.random.Intn(len(alts))], data)
+		}
+	}
+
+	switch msg := message.(type) {
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(msg))
+		for k, m := range msg {
+			rendered[k] = d.render(m, data)
+		}
+		return rendered
+	case map[interface{}]interface{}:
+		rendered := make(map[interface{}]interface{}, len(msg))
+		for k, m := range msg {
+			rendered[k] = d.render(m, data)
+		}
+		return rendered
+	}
+	return message
+}
+
+// StateName returns the name of a state
+func (d *Domain) StateName(state int) string {
+	for name, i := range d.StateTable {
+		if i == state {
+			return name
+		}
+	}
+	return ""
+}
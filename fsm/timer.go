@@ -0,0 +1,70 @@
+package fsm
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Timeout models what happens after a number of seconds without messages in
+// a state: a message is sent as a follow-up and, if into is set, the FSM
+// transitions into another state
+type Timeout struct {
+	State   string      `yaml:"state"`
+	After   int         `yaml:"after"`
+	Into    string      `yaml:"into"`
+	Message interface{} `yaml:"message"`
+}
+
+// Timer models a Timeout scheduled for a user, it fires at Due if the FSM of
+// the user is still in State
+type Timer struct {
+	User    string    `json:"user"`
+	Channel string    `json:"channel,omitempty"`
+	State   int       `json:"state"`
+	Index   int       `json:"index"`
+	Due     time.Time `json:"due"`
+}
+
+// maxDue is the maximum number of due timers returned at once by a store
+const maxDue = 100
+
+// Timers returns the timers for the timeouts of the state of an FSM,
+// starting at a given time
+func (d *Domain) Timers(user, channel string, m *FSM, now time.Time) []Timer {
+	timers := make([]Timer, 0)
+	if m.Handoff {
+		return timers
+	}
+	for i, timeout := range d.TimeoutTable[m.State] {
+		timers = append(timers, Timer{
+			User:    user,
+			Channel: channel,
+			State:   m.State,
+			Index:   i,
+			Due:     now.Add(time.Duration(timeout.After) * time.Second),
+		})
+	}
+	return timers
+}
+
+// ExecuteTimeout executes the timeout of a timer, the FSM goes into its state
+// if it has one, and its message is returned. Nothing is executed if the FSM
+// is no longer in the state of the timer or the timeout doesn't exist.
+func (m *FSM) ExecuteTimeout(t Timer, dom Domain) (response interface{}, executed bool) {
+	timeouts := dom.TimeoutTable[t.State]
+	if m.Handoff || m.State != t.State || t.Index >= len(timeouts) {
+		return nil, false
+	}
+	timeout := timeouts[t.Index]
+
+	if timeout.Into != "" {
+		m.State = dom.StateTable[timeout.Into]
+	}
+	log.Debugf("FSM | timed out after %vs, transitioned %v -> %v\n", timeout.After, t.State, m.State)
+
+	if timeout.Message != nil {
+		response = dom.Render(timeout.Message, m)
+	}
+	return response, true
+}
@@ -0,0 +1,223 @@
+package fsm
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	cmn "github.com/jaimeteb/chatto/common"
+	"github.com/jaimeteb/chatto/ent"
+)
+
+// Validate checks the configuration for unknown states and commands, invalid
+// slots, timeouts and button payloads, and states or commands that are never
+// used
+func (c *Config) Validate() cmn.Validation {
+	var v cmn.Validation
+
+	states := make(map[string]bool)
+	for _, state := range c.States {
+		if state == "any" {
+			v.Errorf("state 'any' is reserved")
+		} else if states[state] {
+			v.Errorf("state '%v' is declared more than once", state)
+		}
+		states[state] = true
+	}
+
+	for _, form := range c.Forms {
+		if form.Name == "any" {
+			v.Errorf("form 'any' is reserved")
+		} else if states[form.Name] {
+			v.Errorf("form '%v' is declared more than once or has the name of a state", form.Name)
+		}
+		states[form.Name] = true
+	}
+
+	commands := make(map[string]bool)
+	for _, command := range c.Commands {
+		if command == "any" {
+			v.Errorf("command 'any' is reserved")
+		} else if commands[command] {
+			v.Errorf("command '%v' is declared more than once", command)
+		}
+		commands[command] = true
+	}
+
+	extractors, err := ent.New(c.Entities)
+	if err != nil {
+		v.Errorf("%v", err)
+	}
+
+	reached := make(map[string]bool)
+	left := make(map[string]bool)
+	used := make(map[string]bool)
+	leavesAny := false
+	for i, function := range c.Functions {
+		from, into := function.Transition.From, function.Transition.Into
+
+		if from == "any" {
+			leavesAny = true
+		} else if !states[from] {
+			v.Errorf("function %v: unknown state '%v' in transition from", i, from)
+		}
+		if !states[into] {
+			v.Errorf("function %v: unknown state '%v' in transition into", i, into)
+		}
+		if function.Command != "any" && !commands[function.Command] {
+			v.Errorf("function %v: unknown command '%v'", i, function.Command)
+		}
+
+		validateSlot(&v, fmt.Sprintf("function %v", i), function.Slot, extractors)
+
+		if onError := function.OnError; onError != nil {
+			if message, ok := function.Message.(string); !ok || !strings.HasPrefix(message, "ext_") {
+				v.Warnf("function %v: on_error is only used with extensions", i)
+			}
+			if onError.Into != "" && !states[onError.Into] {
+				v.Errorf("function %v: unknown state '%v' in on_error into", i, onError.Into)
+			} else if onError.Into != "" {
+				reached[onError.Into] = true
+			}
+		}
+
+		reached[into] = true
+		left[from] = true
+		used[function.Command] = true
+	}
+
+	for _, form := range c.Forms {
+		where := fmt.Sprintf("form '%v'", form.Name)
+		if !states[form.Into] {
+			v.Errorf("%v: unknown state '%v' in into", where, form.Into)
+		}
+		if form.Message == nil {
+			v.Errorf("%v: form has no message", where)
+		}
+		if len(form.Slots) == 0 {
+			v.Errorf("%v: form has no slots", where)
+		}
+
+		names := make(map[string]bool)
+		for _, slot := range form.Slots {
+			if names[slot.Name] {
+				v.Errorf("%v: slot '%v' is declared more than once", where, slot.Name)
+			}
+			names[slot.Name] = true
+
+			validateSlot(&v, where, slot.Slot(), extractors)
+			if slot.Prompt == nil {
+				v.Errorf("%v: slot '%v' has no prompt", where, slot.Name)
+			}
+			if _, err := regexp.Compile(slot.Validate); err != nil {
+				v.Errorf("%v: invalid validation regex for slot '%v': %v", where, slot.Name, err)
+			}
+		}
+
+		reached[form.Into] = true
+		left[form.Name] = true
+	}
+
+	for i, timeout := range c.Timeouts {
+		if timeout.State == "any" || !states[timeout.State] {
+			v.Errorf("timeout %v: unknown state '%v'", i, timeout.State)
+		}
+		if timeout.Into != "" && !states[timeout.Into] {
+			v.Errorf("timeout %v: unknown state '%v' in into", i, timeout.Into)
+		} else if timeout.Into != "" {
+			reached[timeout.Into] = true
+		}
+		if timeout.After <= 0 {
+			v.Errorf("timeout %v: after must be a positive number of seconds", i)
+		}
+		if timeout.Into == "" && timeout.Message == nil {
+			v.Warnf("timeout %v: timeout has no into nor message", i)
+		}
+	}
+
+	for _, form := range c.Forms {
+		if !reached[form.Name] {
+			v.Warnf("form '%v' is unreachable", form.Name)
+		}
+	}
+
+	templates := make(map[string]*template.Template)
+	for where, message := range c.messages() {
+		if err := parseTemplates(message, templates); err != nil {
+			v.Errorf("%v: %v", where, err)
+		}
+		for _, payload := range payloads(message) {
+			if !isTemplate(payload) && !commands[payload] {
+				v.Errorf("%v: unknown command '%v' in button payload", where, payload)
+			}
+		}
+	}
+
+	for i, state := range c.States {
+		if i != 0 && !reached[state] {
+			v.Warnf("state '%v' is unreachable", state)
+		}
+		if !leavesAny && !left[state] {
+			v.Warnf("state '%v' is a dead end", state)
+		}
+	}
+
+	for _, command := range c.Commands {
+		if !used[command] {
+			v.Warnf("command '%v' has no transitions", command)
+		}
+	}
+
+	return v
+}
+
+// payloads returns the payloads of the buttons and quick replies in a message
+func payloads(message interface{}) []string {
+	found := make([]string, 0)
+	switch msg := message.(type) {
+	case []interface{}:
+		for _, m := range msg {
+			found = append(found, payloads(m)...)
+		}
+	case map[string]interface{}, map[interface{}]interface{}:
+		if alts, ok := alternatives(msg); ok {
+			return payloads(alts)
+		}
+		m := cmn.MessageFromMap(msg)
+		for _, choice := range m.Choices() {
+			if choice.Payload != "" {
+				found = append(found, choice.Payload)
+			}
+		}
+	}
+	return found
+}
+
+// validateSlot checks the mode, regex and entity of a slot
+func validateSlot(v *cmn.Validation, where string, slot Slot, extractors ent.Extractors) {
+	namedGroups := false
+
+	switch slot.Mode {
+	case "":
+		return
+	case "whole_text":
+	case "regex":
+		r, err := regexp.Compile(slot.Regex)
+		if err != nil {
+			v.Errorf("%v: invalid regex for slot '%v': %v", where, slot.Name, err)
+			return
+		}
+		namedGroups = hasNamedGroups(r)
+	case "entity":
+		if _, ok := extractors[slot.Entity]; !ok && extractors != nil {
+			v.Errorf("%v: unknown entity '%v' for slot '%v'", where, slot.Entity, slot.Name)
+		}
+	default:
+		v.Errorf("%v: unknown mode '%v' for slot '%v'", where, slot.Mode, slot.Name)
+	}
+
+	if slot.Name == "" && !namedGroups {
+		v.Errorf("%v: slot has no name", where)
+	}
+}
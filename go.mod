@@ -6,19 +6,24 @@ require (
 	github.com/ajg/form v1.5.1
 	github.com/asmcos/requests v0.0.0-20200816142649-95abc76c8cac
 	github.com/fatih/color v1.10.0
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-redis/redis/v8 v8.2.3
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/inconshreveable/log15 v0.0.0-20201112154412-8562bdadbbac // indirect
 	github.com/kevinburke/go-types v0.0.0-20201208005256-aee49f568a20 // indirect
 	github.com/kevinburke/go.uuid v1.2.0 // indirect
 	github.com/kevinburke/rest v0.0.0-20201227061732-08c743d5885c // indirect
 	github.com/kevinburke/twilio-go v0.0.0-20201227055203-2316c1f6c171
 	github.com/kimrgrey/go-telegram v0.0.0-20170122230828-955a999278a2
-	github.com/mitchellh/mapstructure v1.3.3 // indirect
+	github.com/lib/pq v1.9.0
+	github.com/mattn/go-sqlite3 v1.14.6
+	github.com/mitchellh/mapstructure v1.3.3
 	github.com/navossoc/bayesian v0.0.0-20171203014413-18fc5ea11e24
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/pelletier/go-toml v1.8.0 // indirect
-	github.com/sirupsen/logrus v1.2.0
+	github.com/prometheus/client_golang v1.9.0
+	github.com/sirupsen/logrus v1.6.0
 	github.com/slack-go/slack v0.8.0
 	github.com/spf13/afero v1.3.3 // indirect
 	github.com/spf13/cast v1.3.1 // indirect
@@ -27,7 +32,7 @@ require (
 	github.com/spf13/viper v1.7.1
 	github.com/ttacon/builder v0.0.0-20170518171403-c099f663e1c2 // indirect
 	github.com/ttacon/libphonenumber v1.1.0 // indirect
-	golang.org/x/sys v0.0.0-20200803150936-fd5f0c170ac3 // indirect
 	golang.org/x/text v0.3.3 // indirect
 	gopkg.in/ini.v1 v1.57.0 // indirect
+	gopkg.in/yaml.v2 v2.3.0
 )
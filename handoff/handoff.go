@@ -0,0 +1,133 @@
+package handoff
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+	"github.com/jaimeteb/chatto/fsm"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config struct models a handoff configuration in bot.yml, the events of the
+// handed off conversations are posted to a webhook or pushed to a Redis list,
+// whose connection is configured like the one of the FSM store
+type Config struct {
+	fsm.RedisConfig `mapstructure:",squash"`
+
+	Type    string `mapstructure:"type"`
+	URL     string `mapstructure:"url"`
+	Timeout int    `mapstructure:"timeout"`
+	Queue   string `mapstructure:"queue"`
+}
+
+// Event types
+const (
+	// Started is sent when a conversation is handed off
+	Started = "handoff"
+	// Message is sent for every message received while handed off
+	Message = "message"
+	// Released is sent when the bot takes the conversation back
+	Released = "release"
+)
+
+// Event models something that happened in a handed off conversation
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Sender  string    `json:"sender"`
+	Channel string    `json:"channel,omitempty"`
+	Text    string    `json:"text,omitempty"`
+}
+
+// Forwarder interface models where the events of handed off conversations
+// are forwarded to the agents
+type Forwarder interface {
+	Forward(event Event) error
+	// Close closes the connections of the Forwarder
+	Close() error
+}
+
+// WebhookForwarder posts the events as JSON to a URL
+type WebhookForwarder struct {
+	URL     string
+	Timeout time.Duration
+}
+
+// Forward for WebhookForwarder
+func (f *WebhookForwarder) Forward(event Event) error {
+	js, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: f.Timeout}
+	resp, err := client.Post(f.URL, "application/json", bytes.NewBuffer(js))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("handoff webhook responded %v", resp.Status)
+	}
+	return nil
+}
+
+// Close for WebhookForwarder
+func (f *WebhookForwarder) Close() error {
+	return nil
+}
+
+// RedisForwarder pushes the events as JSON to a Redis list
+type RedisForwarder struct {
+	R     *redis.Client
+	Queue string
+}
+
+// Forward for RedisForwarder
+func (f *RedisForwarder) Forward(event Event) error {
+	js, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return f.R.RPush(context.Background(), f.Queue, js).Err()
+}
+
+// Close for RedisForwarder
+func (f *RedisForwarder) Close() error {
+	return f.R.Close()
+}
+
+// Load loads a Forwarder according to the configuration, it returns nil if
+// there is no handoff configured or it can't be used
+func Load(hc Config) Forwarder {
+	switch hc.Type {
+	case "WEBHOOK":
+		timeout := 10 * time.Second
+		if hc.Timeout > 0 {
+			timeout = time.Duration(hc.Timeout) * time.Second
+		}
+		log.Info("Registered handoff WebhookForwarder")
+		log.Infof("* URL:    %v\n", hc.URL)
+		return &WebhookForwarder{URL: hc.URL, Timeout: timeout}
+	case "REDIS":
+		if hc.Queue == "" {
+			hc.Queue = "handoff"
+		}
+		RDB, err := fsm.NewRedisClient(hc.RedisConfig)
+		if err != nil {
+			log.Warnf("Couldn't connect to Redis, handed off messages won't be forwarded: %v", err)
+			return nil
+		}
+		log.Info("Registered handoff RedisForwarder")
+		log.Infof("* Addr:   %v\n", RDB.Options().Addr)
+		log.Infof("* Queue:  %v\n", hc.Queue)
+		return &RedisForwarder{R: RDB, Queue: hc.Queue}
+	}
+	return nil
+}
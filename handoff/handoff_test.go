@@ -0,0 +1,59 @@
+package handoff
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jaimeteb/chatto/fsm"
+)
+
+func TestWebhookForwarder(t *testing.T) {
+	events := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	forwarder := Load(Config{Type: "WEBHOOK", URL: server.URL})
+	if err := forwarder.Forward(Event{Type: Message, Sender: "foo", Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event.Type != Message || event.Sender != "foo" || event.Text != "hello" {
+		t.Errorf("incorrect, got: %v, want: %v.", event, Event{Type: Message, Sender: "foo", Text: "hello"})
+	}
+
+	failing := Load(Config{Type: "WEBHOOK", URL: server.URL + "/nowhere\x7f"})
+	if err := failing.Forward(Event{Type: Message, Sender: "foo"}); err == nil {
+		t.Error("incorrect, want: error for an invalid URL")
+	}
+}
+
+func TestWebhookForwarderStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	forwarder := Load(Config{Type: "WEBHOOK", URL: server.URL})
+	if err := forwarder.Forward(Event{Type: Message, Sender: "foo"}); err == nil {
+		t.Error("incorrect, want: error when the webhook fails")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	if forwarder := Load(Config{}); forwarder != nil {
+		t.Errorf("incorrect, got: %v, want: %v.", forwarder, nil)
+	}
+	if forwarder := Load(Config{Type: "REDIS", RedisConfig: fsm.RedisConfig{Host: "localhost", Password: "pass"}}); forwarder != nil {
+		if _, ok := forwarder.(*RedisForwarder); !ok {
+			t.Errorf("incorrect, got: %T, want: %v.", forwarder, "*RedisForwarder")
+		}
+	}
+}
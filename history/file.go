@@ -0,0 +1,166 @@
+package history
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileStore keeps the history of every sender in a JSON lines file
+type FileStore struct {
+	pruner
+
+	Path  string
+	mutex sync.Mutex
+}
+
+// NewFileStore returns a FileStore that writes into the directory in path,
+// creating it if needed
+func NewFileStore(path string) (*FileStore, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{Path: path}, nil
+}
+
+// file returns the name of the file of a sender, encoded so that any sender
+// is a valid file name
+func (s *FileStore) file(sender string) string {
+	return filepath.Join(s.Path, hex.EncodeToString([]byte(sender))+".jsonl")
+}
+
+// Add for FileStore
+func (s *FileStore) Add(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f, err := os.OpenFile(s.file(entry.Sender), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Get for FileStore
+func (s *FileStore) Get(sender string, limit int) ([]Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, err := s.read(s.file(sender))
+	if err != nil {
+		return nil, err
+	}
+	return last(entries, limit), nil
+}
+
+// Prune for FileStore
+func (s *FileStore) Prune(before time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(s.Path)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range files {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".jsonl") {
+			continue
+		}
+		file := filepath.Join(s.Path, info.Name())
+
+		entries, err := s.read(file)
+		if err != nil {
+			return err
+		}
+
+		kept := make([]Entry, 0)
+		for _, entry := range entries {
+			if !entry.Time.Before(before) {
+				kept = append(kept, entry)
+			}
+		}
+
+		if len(kept) == len(entries) {
+			continue
+		} else if len(kept) == 0 {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		} else if err := write(file, kept); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close for FileStore
+func (s *FileStore) Close() error {
+	s.stop()
+	return nil
+}
+
+// read reads the entries in a file, a missing file has no entries
+func (s *FileStore) read(file string) ([]Entry, error) {
+	entries := make([]Entry, 0)
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// write replaces the entries in a file
+func write(file string, entries []Entry) error {
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
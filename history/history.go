@@ -0,0 +1,156 @@
+package history
+
+import (
+	"sync"
+	"time"
+
+	cmn "github.com/jaimeteb/chatto/common"
+	"github.com/jaimeteb/chatto/fsm"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config struct models a history store configuration in bot.yml, the Redis
+// connection is configured like the one of the FSM store
+type Config struct {
+	fsm.RedisConfig `mapstructure:",squash"`
+
+	Type   string `mapstructure:"type"`
+	TTL    int    `mapstructure:"ttl"`
+	Purge  int    `mapstructure:"purge"`
+	Path   string `mapstructure:"path"`
+	Prefix string `mapstructure:"prefix"`
+}
+
+// Entry models a turn of a conversation: the inbound message, the command
+// predicted for it, the transition it caused and the outbound responses.
+// While the conversation is handed off the inbound messages are forwarded and
+// the responses are sent by the agents.
+type Entry struct {
+	Time        time.Time     `json:"time"`
+	Sender      string        `json:"sender"`
+	Channel     string        `json:"channel"`
+	Text        string        `json:"text"`
+	Command     string        `json:"command"`
+	Probability float64       `json:"probability"`
+	From        string        `json:"from"`
+	Into        string        `json:"into"`
+	Extension   string        `json:"extension,omitempty"`
+	Responses   []cmn.Message `json:"responses"`
+	Handoff     bool          `json:"handoff,omitempty"`
+}
+
+// Store interface for history stores
+type Store interface {
+	// Add adds an entry to the history of its sender
+	Add(entry Entry) error
+	// Get returns the last entries of a sender in chronological order, all of
+	// them if limit is not positive
+	Get(sender string, limit int) ([]Entry, error)
+	// Prune removes the entries older than a given time
+	Prune(before time.Time) error
+	// Close stops pruning the store and closes its connections
+	Close() error
+}
+
+// prunable is a Store that can prune its old entries periodically
+type prunable interface {
+	Store
+	prune(store Store, ttl, interval time.Duration)
+}
+
+// Load loads a history Store according to the configuration and starts
+// pruning its old entries if it has a TTL, the history is disabled and nil is
+// returned if there is no type
+func Load(hc Config) Store {
+	var store Store
+
+	switch hc.Type {
+	case "":
+		log.Info("History is disabled")
+		return nil
+	case "MEMORY":
+		store = NewMemoryStore()
+		log.Info("Registered history MemoryStore")
+	case "FILE":
+		if hc.Path == "" {
+			hc.Path = "history"
+		}
+		fileStore, err := NewFileStore(hc.Path)
+		if err != nil {
+			log.Warnf("Couldn't use history path %v, using MemoryStore instead: %v", hc.Path, err)
+			store = NewMemoryStore()
+			break
+		}
+		store = fileStore
+		log.Info("Registered history FileStore")
+		log.Infof("* Path:   %v\n", hc.Path)
+	case "REDIS":
+		RDB, err := fsm.NewRedisClient(hc.RedisConfig)
+		if err != nil {
+			log.Warnf("Couldn't connect to Redis, using history MemoryStore instead: %v", err)
+			store = NewMemoryStore()
+			break
+		}
+		store = &RedisStore{R: RDB, TTL: hc.TTL, Prefix: hc.Prefix}
+		log.Info("Registered history RedisStore")
+		log.Infof("* Addr:   %v\n", RDB.Options().Addr)
+	default:
+		log.Warnf("Unknown history type %v, using MemoryStore instead", hc.Type)
+		store = NewMemoryStore()
+	}
+
+	if hc.TTL > 0 {
+		if hc.Purge <= 0 {
+			hc.Purge = 60
+		}
+		if p, ok := store.(prunable); ok {
+			p.prune(store, time.Duration(hc.TTL)*time.Second, time.Duration(hc.Purge)*time.Second)
+		}
+	}
+	log.Infof("* TTL:    %v\n", hc.TTL)
+
+	return store
+}
+
+// pruner prunes the entries of a store periodically until it's stopped, the
+// stores embed it
+type pruner struct {
+	once sync.Once
+	done chan struct{}
+}
+
+// prune starts pruning the entries of store older than ttl every interval
+func (p *pruner) prune(store Store, ttl, interval time.Duration) {
+	p.done = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := store.Prune(time.Now().Add(-ttl)); err != nil {
+					log.Error("Error pruning history:", err)
+				}
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops pruning, if it was started
+func (p *pruner) stop() {
+	p.once.Do(func() {
+		if p.done != nil {
+			close(p.done)
+		}
+	})
+}
+
+// last returns the last limit entries, or all of them if limit is not positive
+func last(entries []Entry, limit int) []Entry {
+	if limit > 0 && len(entries) > limit {
+		return entries[len(entries)-limit:]
+	}
+	return entries
+}
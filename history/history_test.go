@@ -0,0 +1,85 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	cmn "github.com/jaimeteb/chatto/common"
+	"github.com/jaimeteb/chatto/fsm"
+)
+
+func testStore(t *testing.T, store Store) {
+	now := time.Now()
+	for i, text := range []string{"hi", "good", "bye"} {
+		err := store.Add(Entry{
+			Time:      now.Add(time.Duration(i-2) * time.Hour),
+			Sender:    "foo",
+			Text:      text,
+			Responses: []cmn.Message{{Text: "ok"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Add(Entry{Time: now, Sender: "bar", Text: "hello"})
+
+	if entries, _ := store.Get("foo", 0); len(entries) != 3 || entries[0].Text != "hi" {
+		t.Errorf("incorrect, got: %v, want: %v.", entries, "3 entries starting with 'hi'")
+	}
+	if entries, _ := store.Get("foo", 2); len(entries) != 2 || entries[0].Text != "good" || entries[1].Responses[0].Text != "ok" {
+		t.Errorf("incorrect, got: %v, want: %v.", entries, "2 entries starting with 'good'")
+	}
+	if entries, _ := store.Get("baz", 0); len(entries) != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", entries, "no entries")
+	}
+
+	if err := store.Prune(now.Add(-90 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := store.Get("foo", 0); len(entries) != 2 || entries[0].Text != "good" {
+		t.Errorf("incorrect, got: %v, want: %v.", entries, "2 entries starting with 'good'")
+	}
+
+	store.Prune(now.Add(time.Minute))
+	if entries, _ := store.Get("bar", 0); len(entries) != 0 {
+		t.Errorf("incorrect, got: %v, want: %v.", entries, "no entries")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	if store := Load(Config{}); store != nil {
+		t.Errorf("incorrect, got: %v, want: %v.", store, "nil, history disabled")
+	}
+	testStore(t, Load(Config{Type: "MEMORY"}))
+
+	store := Load(Config{Type: "MEMORY", TTL: 60, Purge: 1})
+	if err := store.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := Load(Config{Type: "FILE", Path: dir})
+	if _, ok := store.(*FileStore); !ok {
+		t.Fatalf("incorrect, got: %T, want: %v.", store, "*FileStore")
+	}
+	testStore(t, store)
+}
+
+func TestRedisStoreFail(t *testing.T) {
+	store := Load(Config{Type: "REDIS", RedisConfig: fsm.RedisConfig{Host: "localhost", Password: "foo"}})
+	if _, ok := store.(*MemoryStore); !ok {
+		t.Errorf("incorrect, got: %T, want: %v.", store, "*MemoryStore")
+	}
+}
@@ -0,0 +1,61 @@
+package history
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the history in memory
+type MemoryStore struct {
+	pruner
+
+	mutex   sync.RWMutex
+	entries map[string][]Entry
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string][]Entry)}
+}
+
+// Add for MemoryStore
+func (s *MemoryStore) Add(entry Entry) error {
+	s.mutex.Lock()
+	s.entries[entry.Sender] = append(s.entries[entry.Sender], entry)
+	s.mutex.Unlock()
+	return nil
+}
+
+// Get for MemoryStore
+func (s *MemoryStore) Get(sender string, limit int) ([]Entry, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entries := last(s.entries[sender], limit)
+	return append([]Entry{}, entries...), nil
+}
+
+// Prune for MemoryStore
+func (s *MemoryStore) Prune(before time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for sender, entries := range s.entries {
+		i := 0
+		for i < len(entries) && entries[i].Time.Before(before) {
+			i++
+		}
+		if i == len(entries) {
+			delete(s.entries, sender)
+		} else if i > 0 {
+			s.entries[sender] = append([]Entry{}, entries[i:]...)
+		}
+	}
+	return nil
+}
+
+// Close for MemoryStore
+func (s *MemoryStore) Close() error {
+	s.stop()
+	return nil
+}
@@ -0,0 +1,86 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+)
+
+var ctx = context.Background()
+
+// RedisStore keeps the history of every sender in a Redis sorted set scored
+// by the time of the entries in microseconds, in the key
+// "<prefix>history:<sender>"
+type RedisStore struct {
+	pruner
+
+	R      *redis.Client
+	TTL    int
+	Prefix string
+}
+
+func (s *RedisStore) key(sender string) string {
+	return s.Prefix + "history:" + sender
+}
+
+// Add for RedisStore
+func (s *RedisStore) Add(entry Entry) error {
+	member, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	key := s.key(entry.Sender)
+	pipe := s.R.TxPipeline()
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(entry.Time.UnixNano() / 1e3), Member: member})
+	if s.TTL > 0 {
+		pipe.Expire(ctx, key, time.Duration(s.TTL)*time.Second)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Get for RedisStore
+func (s *RedisStore) Get(sender string, limit int) ([]Entry, error) {
+	start := int64(0)
+	if limit > 0 {
+		start = -int64(limit)
+	}
+
+	members, err := s.R.ZRange(ctx, s.key(sender), start, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(members))
+	for _, member := range members {
+		var entry Entry
+		if err := json.Unmarshal([]byte(member), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Prune for RedisStore
+func (s *RedisStore) Prune(before time.Time) error {
+	max := "(" + strconv.FormatInt(before.UnixNano()/1e3, 10)
+
+	iter := s.R.Scan(ctx, 0, s.key("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		if err := s.R.ZRemRangeByScore(ctx, iter.Val(), "-inf", max).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// Close for RedisStore
+func (s *RedisStore) Close() error {
+	s.stop()
+	return s.R.Close()
+}
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Fallback types, the default messages sent instead of a transition
+const (
+	Unsure  = "unsure"
+	Unknown = "unknown"
+	Error   = "error"
+)
+
+var (
+	// Requests counts the requests to every endpoint by status code
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chatto_http_requests_total",
+		Help: "Number of HTTP requests by endpoint, method and status code.",
+	}, []string{"endpoint", "method", "code"})
+
+	// RequestDuration observes the latency of the requests to every endpoint
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chatto_http_request_duration_seconds",
+		Help:    "Latency of the HTTP requests by endpoint and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint", "method"})
+
+	// Commands counts the commands predicted for the messages received
+	Commands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chatto_predicted_commands_total",
+		Help: "Number of messages by predicted command.",
+	}, []string{"command"})
+
+	// Probabilities observes the probability of the predictions
+	Probabilities = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chatto_prediction_probability",
+		Help:    "Probability of the commands predicted by the classifier.",
+		Buckets: []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1},
+	})
+
+	// Fallbacks counts the unsure, unknown and error default messages sent
+	Fallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chatto_fallbacks_total",
+		Help: "Number of default messages sent by type: unsure, unknown or error.",
+	}, []string{"type"})
+
+	// ExtensionDuration observes the latency of the extension functions
+	ExtensionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chatto_extension_duration_seconds",
+		Help:    "Latency of the extension function calls by function name.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"function"})
+
+	// ExtensionFailures counts the extension function calls that failed
+	ExtensionFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chatto_extension_failures_total",
+		Help: "Number of failed extension function calls by function name.",
+	}, []string{"function"})
+)
+
+// Instrument returns a handler that counts and times the requests to an
+// endpoint
+func Instrument(endpoint string, h http.Handler) http.Handler {
+	labels := prometheus.Labels{"endpoint": endpoint}
+	return promhttp.InstrumentHandlerDuration(
+		RequestDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(Requests.MustCurryWith(labels), h),
+	)
+}
+
+// ObserveExtension observes the latency of an extension function call that
+// started at a given time
+func ObserveExtension(extName string, start time.Time) {
+	ExtensionDuration.WithLabelValues(extName).Observe(time.Since(start).Seconds())
+}
+
+// SendersInterval is how long the number of active senders is cached, since
+// counting them can scan the whole store
+const SendersInterval = time.Minute
+
+// RegisterSenders registers a gauge with the number of active senders given
+// by count, which is called at most once every interval
+func RegisterSenders(count func() int, interval time.Duration) error {
+	var (
+		mutex   sync.Mutex
+		senders float64
+		counted time.Time
+	)
+	return prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "chatto_active_senders",
+		Help: "Number of senders with a conversation in the store.",
+	}, func() float64 {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if counted.IsZero() || time.Since(counted) >= interval {
+			senders = float64(count())
+			counted = time.Now()
+		}
+		return senders
+	}))
+}
+
+// Handler returns the handler for the metrics endpoint
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
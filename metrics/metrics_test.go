@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrument(t *testing.T) {
+	h := Instrument("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusTeapot)
+	}))
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "/test", nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if n := testutil.ToFloat64(Requests.WithLabelValues("test", "post", "418")); n != 2 {
+		t.Errorf("incorrect, got: %v, want: %v.", n, 2)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	senders := 3
+	if err := RegisterSenders(func() int { return senders }, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	Commands.WithLabelValues("greet").Inc()
+	Probabilities.Observe(0.75)
+	ObserveExtension("ext_any", time.Now())
+
+	scrape := func() string {
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	body := scrape()
+	for _, want := range []string{
+		"chatto_active_senders 3",
+		`chatto_predicted_commands_total{command="greet"} 1`,
+		`chatto_prediction_probability_bucket{le="0.8"} 1`,
+		`chatto_extension_duration_seconds_count{function="ext_any"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("incorrect, metrics do not contain: %v.", want)
+		}
+	}
+
+	// The senders are counted again only after the interval
+	senders = 5
+	if body := scrape(); !strings.Contains(body, "chatto_active_senders 3") {
+		t.Errorf("incorrect, metrics do not contain: %v.", "chatto_active_senders 3")
+	}
+}